@@ -0,0 +1,476 @@
+// Package assembler assembles LASM source into machine words.
+package assembler
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Instruction is a line of source that assembles to a single word.
+type Instruction struct {
+	Text    string
+	Line    int    // Line number in the source, starting at 1
+	File    string // File the instruction is in, empty for source that isn't a file
+	Address int    // Address the instruction is placed at
+	value   string // Value the word holds, for a line of .word or .byte values
+	column  int    // Column of that value in Text, starting at 1
+}
+
+// Location describes where the instruction is in the source.
+func (i Instruction) Location() string {
+	return location(i.File, i.Line)
+}
+
+// Fields splits the instruction into its mnemonic and operands. A word from
+// a .word or .byte line only has the value it holds as an operand.
+func (i Instruction) Fields() []string {
+	fields := splitOperands(i.Text)
+	if i.value != "" {
+		return []string{fields[0], i.value}
+	}
+	return fields
+}
+
+// Tag is a named address in the program.
+type Tag struct {
+	Address    int
+	Line       int    // Source line the tag is defined on
+	File       string // File the tag is in, empty for source that isn't a file
+	Referenced bool   // Whether any instruction uses the tag
+}
+
+// Location describes where the tag is defined in the source.
+func (t Tag) Location() string {
+	return location(t.File, t.Line)
+}
+
+func location(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("line %d of %s", line, file)
+}
+
+// symbols holds the names defined in the source.
+type symbols struct {
+	tags      map[string]*Tag
+	constants map[string]*constant
+}
+
+// constant is a name defined with .equ.
+type constant struct {
+	value    string // Data the name stands for
+	location string // Where the constant is defined
+}
+
+// Word is an assembled instruction split into its encoded fields. Words from
+// data directives have no opcode or destination and hold the whole word in
+// Data.
+type Word struct {
+	Opcode string
+	Dest   string
+	Data   string
+	Source Instruction
+}
+
+// Bits returns the whole machine word as a binary string.
+func (w Word) Bits() string {
+	return w.Opcode + w.Dest + w.Data
+}
+
+// Value returns the machine word as an integer.
+func (w Word) Value() (uint64, error) {
+	return strconv.ParseUint(w.Bits(), 2, 64)
+}
+
+// Program is the result of assembling a source file.
+type Program struct {
+	Words []Word
+	Tags  map[string]*Tag
+
+	// Directives lists the lines that don't place a word, such as .org,
+	// .equ and uses of macros, at the address they apply at
+	Directives []Instruction
+
+	// Files lists the source files read, including those pulled in with
+	// .include. It is also set when assembly fails.
+	Files []string
+
+	strict []string // Problems found while parsing that only strict mode reports
+}
+
+// Assembler assembles source for the instruction set described by Config.
+type Assembler struct {
+	Config Config
+
+	// Filename is the path of the source passed to Assemble, used to
+	// resolve includes. It can be left empty when the source isn't a file.
+	Filename string
+
+	// Trace receives a line for every assembled instruction as the program
+	// is assembled. Errors are only returned. Nothing is written when it is
+	// nil.
+	Trace io.Writer
+
+	// MaxErrors is how many errors are reported before assembly stops with
+	// ErrTooManyErrors. There is no limit when it is 0.
+	MaxErrors int
+}
+
+// Assemble assembles src without writing a trace.
+func Assemble(src io.Reader, cfg Config) (Program, error) {
+	return (&Assembler{Config: cfg}).Assemble(src)
+}
+
+// AssembleString assembles src and returns one 16 bit word per instruction in
+// source order, without any padding.
+func AssembleString(src string, cfg Config) ([]uint16, error) {
+	program, err := Assemble(strings.NewReader(src), cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	words := make([]uint16, len(program.Words))
+	for i, word := range program.Words {
+		value, err := word.Value()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", word.Source.Location(), err)
+		}
+		if value > math.MaxUint16 {
+			return nil, fmt.Errorf("%s: word %s does not fit in 16 bits", word.Source.Location(), word.Bits())
+		}
+		words[i] = uint16(value)
+	}
+	return words, nil
+}
+
+// Assemble parses and assembles src. Problems in the source are returned
+// together as AssemblyErrors.
+func (a *Assembler) Assemble(src io.Reader) (Program, error) {
+	return a.assemble(func(cfg Config) *parser {
+		return parse(cfg, src, a.Filename)
+	})
+}
+
+// AssembleFiles assembles several files as a single program, placing them in
+// memory in the order given. Filename is ignored.
+func (a *Assembler) AssembleFiles(paths ...string) (Program, error) {
+	return a.assemble(func(cfg Config) *parser {
+		return parseFiles(cfg, paths)
+	})
+}
+
+func (a *Assembler) assemble(parse func(Config) *parser) (Program, error) {
+	cfg := a.Config
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return Program{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	p := parse(cfg)
+	if len(p.errs) > 0 {
+		if a.MaxErrors > 0 && len(p.errs) > a.MaxErrors {
+			return Program{Files: p.files}, errors.Join(p.errs[:a.MaxErrors], ErrTooManyErrors)
+		}
+		return Program{Files: p.files}, p.errs
+	}
+
+	words, errs, aborted := a.assembleProgram(cfg, p.instructions, p.syms)
+	if aborted {
+		return Program{Files: p.files}, errors.Join(errs, ErrTooManyErrors)
+	}
+	if len(errs) > 0 {
+		return Program{Files: p.files}, errs
+	}
+
+	return Program{Words: words, Tags: p.syms.tags, Directives: p.directives, Files: p.files, strict: p.strict}, nil
+}
+
+// Size is the number of words of memory the program spans, from address 0
+// up to and including its highest used address.
+func (p Program) Size() int {
+	size := 0
+	for _, word := range p.Words {
+		size = max(size, word.Source.Address+1)
+	}
+	return size
+}
+
+// Warnings lists every tag that no instruction referenced, in the order they
+// are defined, after a warning for a program with no instructions at all.
+func (p Program) Warnings() []string {
+	var warnings []string
+	if len(p.Words) == 0 {
+		warnings = append(warnings, "no instructions found")
+	}
+
+	var unused []string
+	for name, tag := range p.Tags {
+		if !tag.Referenced {
+			unused = append(unused, name)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		return p.Tags[unused[i]].Line < p.Tags[unused[j]].Line
+	})
+
+	for _, name := range unused {
+		warnings = append(warnings, fmt.Sprintf("tag %s on %s is never referenced", name, p.Tags[name].Location()))
+	}
+	return warnings
+}
+
+// StrictWarnings lists problems found in the source that are tolerated
+// unless strict mode is asked for, such as whitespace other than spaces and
+// tabs. Padding depends on how the program is written out, so it is left to
+// the caller.
+func (p Program) StrictWarnings() []string {
+	return append([]string(nil), p.strict...)
+}
+
+func (a *Assembler) tracef(format string, args ...any) {
+	if a.Trace != nil {
+		fmt.Fprintf(a.Trace, format, args...)
+	}
+}
+
+// assembleProgram assembles every instruction, stopping early and reporting
+// that it was aborted when there are more than MaxErrors errors.
+func (a *Assembler) assembleProgram(cfg Config, instructions []Instruction, syms *symbols) (words []Word, errs AssemblyErrors, aborted bool) {
+	a.tracef("\nAssembling binary:\n\n")
+	a.tracef("%s\n", strings.Repeat("-", 39))
+
+	for _, instr := range instructions {
+		word, err := a.assembleInstruction(cfg, instr, syms)
+		if err != nil {
+			if a.MaxErrors > 0 && len(errs) == a.MaxErrors {
+				aborted = true
+				break
+			}
+			assemblyErr := AssemblyError{File: instr.File, Line: instr.Line, Source: instr.Text, Err: err}
+			var tokenErr tokenError
+			if errors.As(err, &tokenErr) {
+				assemblyErr.Column = tokenColumn(instr.Text, tokenErr.token)
+				if instr.value != "" {
+					assemblyErr.Column = instr.column
+				}
+			}
+			errs = append(errs, assemblyErr)
+			continue
+		}
+		word.Source = instr
+		words = append(words, word)
+	}
+
+	a.tracef("%s\n\n", strings.Repeat("-", 39))
+
+	return words, errs, aborted
+}
+
+func (a *Assembler) assembleInstruction(cfg Config, instr Instruction, syms *symbols) (Word, error) {
+	instruction, address := instr.Text, instr.Address
+	parts, empty := splitOperandList(instruction)
+
+	if len(parts) < 1 {
+		return Word{}, fmt.Errorf("invalid instruction format: %s", instruction)
+	}
+
+	// The bits are taken from the whole rest of the line, while the parser
+	// has split .word and .byte lines into their values
+	switch parts[0] {
+	case ".word":
+		return a.assembleData(cfg, instruction, instr.value, cfg.WordWidth, syms, address)
+	case ".byte":
+		return a.assembleData(cfg, instruction, instr.value, 8, syms, address)
+	case ".bits":
+		return a.assembleBits(cfg, instruction, strings.TrimSpace(instruction[len(parts[0]):]), address)
+	}
+
+	name, ok := cfg.opcodeName(parts[0])
+	if !ok {
+		if cfg.isDestination(parts[0]) {
+			return Word{}, tokenError{0, fmt.Errorf("line starts with register %s instead of an opcode", parts[0])}
+		}
+		return Word{}, tokenError{0, fmt.Errorf("unknown opcode: %s", parts[0])}
+	}
+	// An operand left empty by a stray comma would otherwise be dropped, and
+	// the operands after it read as something else
+	if empty >= 0 {
+		return Word{}, tokenError{max(empty-1, 0), fmt.Errorf("empty operand, check for a stray comma: %s", instruction)}
+	}
+	opcode := cfg.Opcodes[name]
+	if err := cfg.checkOperandCount(name, parts[1:]); err != nil {
+		return Word{}, err
+	}
+
+	dest, data, err := cfg.getDestAndData(name, parts)
+	if err != nil {
+		return Word{}, err
+	}
+
+	if dest == "" {
+		dest = strings.Repeat("0", cfg.DestWidth)
+	}
+
+	if data == "" {
+		data = strings.Repeat("0", cfg.DataWidth)
+		if defaultData := cfg.OpcodeSpecs[name].Data; defaultData != "" {
+			// Validate has made sure the default data is well formed
+			data, _ = cfg.processData(defaultData, syms, address)
+		}
+	} else {
+		data, err = cfg.processData(data, syms, address)
+		if err != nil {
+			// The data is always the last operand
+			return Word{}, tokenError{len(parts) - 1, err}
+		}
+	}
+
+	// Checked before the word is traced, so a word of the wrong width never
+	// looks like it was assembled
+	word := Word{Opcode: opcode, Dest: dest, Data: data}
+	if bits := len(word.Bits()); bits != cfg.WordWidth {
+		return Word{}, fmt.Errorf("instruction is %d bits long (%d bit opcode, %d bit destination and %d bit data) but words are %d bits",
+			bits, len(opcode), len(dest), len(data), cfg.WordWidth)
+	}
+
+	prettyInstruction := fmt.Sprintf("%s %s %s", opcode, dest, data)
+	paddedInstruction := fmt.Sprintf("%-20s", normalizeSpace(instruction))
+	a.tracef("%3d %02X: %s %-13s\n", address, address, paddedInstruction, prettyInstruction)
+
+	return word, nil
+}
+
+// assembleData assembles a value from a .word or .byte directive into a whole
+// word. The value can be anything allowed as instruction data, but has to fit
+// in the given number of bits instead of the data field.
+func (a *Assembler) assembleData(cfg Config, instruction, value string, width int, syms *symbols, address int) (Word, error) {
+	if width > cfg.WordWidth {
+		return Word{}, fmt.Errorf("%d bit values don't fit in %d bit words", width, cfg.WordWidth)
+	}
+
+	valueCfg := cfg
+	valueCfg.DataWidth = width
+	bits, err := valueCfg.processData(value, syms, address)
+	if err != nil {
+		return Word{}, tokenError{1, err}
+	}
+	bits = strings.Repeat("0", cfg.WordWidth-width) + bits
+
+	a.tracef("%3d %02X: %-20s %s\n", address, address, normalizeSpace(instruction), bits)
+
+	return Word{Data: bits}, nil
+}
+
+// assembleBits places the bit string from a .bits directive in a word as it
+// is. It has to be exactly as wide as a word.
+func (a *Assembler) assembleBits(cfg Config, instruction, bits string, address int) (Word, error) {
+	if !isBinary(bits) {
+		return Word{}, tokenError{1, fmt.Errorf(".bits should only contain 0 and 1: %s", bits)}
+	}
+	if len(bits) != cfg.WordWidth {
+		return Word{}, tokenError{1, fmt.Errorf(".bits value is %d bits long but words are %d bits", len(bits), cfg.WordWidth)}
+	}
+
+	a.tracef("%3d %02X: %-20s %s\n", address, address, normalizeSpace(instruction), bits)
+
+	return Word{Data: bits}, nil
+}
+
+// checkOperandCount makes sure an opcode with a given operand shape is used
+// with the right number of operands.
+func (c Config) checkOperandCount(name string, operands []string) error {
+	shape := c.OpcodeSpecs[name].Operands
+	if shape == "" || len(operands) == operandCounts[shape] {
+		return nil
+	}
+	switch shape {
+	case "none":
+		return fmt.Errorf("opcode %s takes no operands", name)
+	case "dest":
+		return fmt.Errorf("opcode %s takes a destination register only", name)
+	case "data":
+		return fmt.Errorf("opcode %s takes data only", name)
+	default:
+		return fmt.Errorf("opcode %s takes a destination register and data", name)
+	}
+}
+
+// normalizeSpace collapses every run of whitespace to a single space, so tabs
+// used to line up the source don't throw off the columns of the trace.
+func normalizeSpace(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// getDestAndData picks the destination and data out of an instruction. When
+// the opcode has an operand shape it decides which is which, otherwise a lone
+// operand is taken as the destination if it names a register.
+func (c Config) getDestAndData(name string, parts []string) (dest string, data string, err error) {
+	switch c.OpcodeSpecs[name].Operands {
+	case "none":
+		return "", "", nil
+	case "dest":
+		dest, err = c.processDestination(name, parts, 1)
+		return dest, "", err
+	case "data":
+		return "", parts[1], nil
+	case "dest+data":
+		dest, err = c.processDestination(name, parts, 1)
+		return dest, parts[2], err
+	}
+
+	switch len(parts) {
+	case 1: // Only opcode
+	case 2: // Opcode and either destination or data
+		if c.isDestination(parts[1]) {
+			dest, err = c.processDestination(name, parts, 1)
+		} else {
+			data = parts[1]
+		}
+	case 3: // Opcode, destination and data
+		dest, err = c.processDestination(name, parts, 1)
+		data = parts[2]
+	default:
+		err = fmt.Errorf("invalid instruction format: %s", strings.Join(parts, " "))
+	}
+	return
+}
+
+func (c Config) isDestination(part string) bool {
+	_, ok := c.lookup(c.Registers, part)
+	return ok
+}
+
+// processDestination encodes the register in the given part of an
+// instruction, checking that the opcode can target it.
+func (c Config) processDestination(name string, parts []string, index int) (string, error) {
+	register, ok := c.canonical(c.Registers, parts[index])
+	if !ok {
+		return "", tokenError{index, fmt.Errorf("invalid destination: %s", parts[index])}
+	}
+	if dests := c.OpcodeSpecs[name].Dests; len(dests) > 0 && !slices.Contains(dests, register) {
+		return "", tokenError{index, fmt.Errorf("opcode %s cannot target %s", name, register)}
+	}
+	return c.Registers[register], nil
+}
+
+// tokenColumn returns the column of the given token of an instruction,
+// starting at 1.
+func tokenColumn(instruction string, token int) int {
+	offset := 0
+	for i, part := range splitOperands(instruction) {
+		offset += strings.Index(instruction[offset:], part)
+		if i == token {
+			return utf8.RuneCountInString(instruction[:offset]) + 1
+		}
+		offset += len(part)
+	}
+	return 0
+}
@@ -0,0 +1,351 @@
+package assembler
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testConfig is the instruction set of the default config.json.
+func testConfig() Config {
+	return Config{Opcodes: map[string]string{
+		"CAL": "0000",
+		"RET": "0001",
+		"BRZ": "0010",
+		"BRN": "0011",
+		"SUB": "0101",
+		"ADD": "0100",
+		"LOD": "0110",
+		"INP": "0111",
+		"OUT": "1000",
+		"AND": "1001",
+		"DUT": "1010",
+	}}
+}
+
+// assembleBits assembles src and returns the bits of each word.
+func assembleBits(src string, cfg Config) ([]string, error) {
+	program, err := Assemble(strings.NewReader(src), cfg)
+	if err != nil {
+		return nil, err
+	}
+	bits := make([]string, len(program.Words))
+	for i, word := range program.Words {
+		bits[i] = word.Bits()
+	}
+	return bits, nil
+}
+
+// checkAssembly checks that src assembles to want, or fails with an error
+// containing wantErr when it is set.
+func checkAssembly(t *testing.T, src string, cfg Config, want []string, wantErr string) {
+	t.Helper()
+	got, err := assembleBits(src, cfg)
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Fatalf("assembling %q: got error %v, want one containing %q", src, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("assembling %q: %v", src, err)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("assembling %q = %q, want %q", src, got, want)
+	}
+}
+
+func TestNegativeData(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    string
+		wantErr string
+	}{
+		{"-128", "10000000", ""},
+		{"-1", "11111111", ""},
+		{"127", "01111111", ""},
+		{"255", "11111111", ""},
+		{"-129", "", "negative decimal data out of range (-128 to -1): -129"},
+		{"256", "", "decimal data out of range (0-255): 256"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			var want []string
+			if tt.wantErr == "" {
+				want = []string{"0110" + "0" + tt.want}
+			}
+			checkAssembly(t, "LOD R0 "+tt.data, testConfig(), want, tt.wantErr)
+		})
+	}
+}
+
+func TestWordWidthIsConstant(t *testing.T) {
+	cfg := testConfig()
+	for value := -128; value <= 255; value++ {
+		for _, src := range []string{
+			fmt.Sprintf("LOD R1 %d", value),
+			fmt.Sprintf("LOD %d", value),
+		} {
+			bits, err := assembleBits(src, cfg)
+			if err != nil {
+				t.Fatalf("assembling %q: %v", src, err)
+			}
+			if len(bits[0]) != 13 {
+				t.Errorf("assembling %q gives %d bits, want 13", src, len(bits[0]))
+			}
+		}
+	}
+	if _, err := assembleBits("LOD R0 300", cfg); err == nil {
+		t.Error("assembling LOD R0 300 succeeded, want an out of range error")
+	}
+}
+
+func TestDuplicateTag(t *testing.T) {
+	src := "#loop\nSUB R0 1\n#loop\nBRN #loop"
+	_, err := Assemble(strings.NewReader(src), testConfig())
+	var errs AssemblyErrors
+	if !errors.As(err, &errs) || len(errs) != 1 {
+		t.Fatalf("got error %v, want a single AssemblyError", err)
+	}
+	if errs[0].Line != 3 || !strings.Contains(errs[0].Error(), "tag loop is already defined on line 1") {
+		t.Errorf("got %q, want the duplicate on line 3 to name line 1", errs[0])
+	}
+}
+
+func TestAllComments(t *testing.T) {
+	src := "// nothing here\n\n   // still nothing\n/* or here */\n"
+	program, err := Assemble(strings.NewReader(src), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Words) != 0 {
+		t.Errorf("got %d words, want none", len(program.Words))
+	}
+	if warnings := program.Warnings(); !slices.Contains(warnings, "no instructions found") {
+		t.Errorf("Warnings() = %q, want it to report no instructions", warnings)
+	}
+}
+
+func TestTagOutOfRange(t *testing.T) {
+	src := strings.Repeat("RET\n", 300) + "#far\nBRN #far\nBRN #start"
+	src = "#start\n" + src
+	checkAssembly(t, src, testConfig(), nil, "jump target out of range (0-255): #far is at address 300")
+}
+
+func TestDataLiterals(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    string
+		wantErr string
+	}{
+		{"0b00001010", "00001010", ""},
+		{"0b0000_1010", "00001010", ""},
+		{"0x0A", "00001010", ""},
+		{"0o12", "00001010", ""},
+		{"'A'", "01000001", ""},
+		{"0b0000000z", "", "binary data should only contain 0 and 1: 0b0000000z"},
+		{"0b0000002x", "", "binary data should only contain 0 and 1"},
+		{"0b1010", "", "binary data should be 8 bits long"},
+		{"0x100", "", "hex data out of range (0-255): 0x100"},
+		{"4294967296*4294967296+5", "", "expression overflows 64 bits"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			var want []string
+			if tt.wantErr == "" {
+				want = []string{"0110" + "0" + tt.want}
+			}
+			checkAssembly(t, "LOD R0 "+tt.data, testConfig(), want, tt.wantErr)
+		})
+	}
+}
+
+func TestOperandSeparators(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"ADD R1 5", "0100100000101"},
+		{"ADD R1, 5", "0100100000101"},
+		{"ADD R1,5", "0100100000101"},
+		{"ADD R1 , 5", "0100100000101"},
+		{"ADD, R1, 5", "0100100000101"},
+		{"OUT 5", "1000000000101"},
+		{"OUT R1", "1000100000000"},
+		{"LOD R0 ','", "0110000101100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			checkAssembly(t, tt.src, testConfig(), []string{tt.want}, "")
+		})
+	}
+}
+
+func TestMalformedLines(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+		column  int
+	}{
+		{"R0", "line starts with register R0 instead of an opcode", 1},
+		{"R1 5", "line starts with register R1 instead of an opcode", 1},
+		{"ADD R0,", "empty operand, check for a stray comma: ADD R0,", 5},
+		{"ADD R0,,5", "empty operand, check for a stray comma", 5},
+		{"ADD R0, ,5", "empty operand, check for a stray comma", 5},
+		{", RET", "empty operand, check for a stray comma", 3},
+		{"#loop ADD R0 1 extra", "invalid instruction format", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Assemble(strings.NewReader(tt.src), testConfig())
+			var errs AssemblyErrors
+			if !errors.As(err, &errs) || len(errs) != 1 {
+				t.Fatalf("got error %v, want a single AssemblyError", err)
+			}
+			if !strings.Contains(errs[0].Error(), tt.wantErr) {
+				t.Errorf("got %q, want it to contain %q", errs[0], tt.wantErr)
+			}
+			if errs[0].Column != tt.column {
+				t.Errorf("got column %d, want %d", errs[0].Column, tt.column)
+			}
+		})
+	}
+}
+
+func TestTagWithoutColon(t *testing.T) {
+	want := []string{"0100000000001", "0011000000000"}
+	for _, src := range []string{
+		"#loop: ADD R0 1\nBRN #loop",
+		"#loop ADD R0 1\nBRN #loop",
+		"#loop\nADD R0 1\nBRN #loop",
+	} {
+		checkAssembly(t, src, testConfig(), want, "")
+	}
+}
+
+func TestRegisterRestriction(t *testing.T) {
+	cfg := testConfig()
+	cfg.OpcodeSpecs = map[string]OpcodeSpec{"ADD": {Bits: "0100", Dests: []string{"R0"}}}
+	checkAssembly(t, "ADD R0 1", cfg, []string{"0100000000001"}, "")
+	checkAssembly(t, "ADD R1 1", cfg, nil, "opcode ADD cannot target R1")
+	// Opcodes without a restriction can still target every register
+	checkAssembly(t, "SUB R1 1", cfg, []string{"0101100000001"}, "")
+}
+
+func TestDefaultData(t *testing.T) {
+	cfg := testConfig()
+	cfg.OpcodeSpecs = map[string]OpcodeSpec{"OUT": {Bits: "1000", Data: "0x2A"}}
+	checkAssembly(t, "OUT", cfg, []string{"1000000101010"}, "")
+	checkAssembly(t, "OUT R1", cfg, []string{"1000100101010"}, "")
+	// Data given in the instruction takes the place of the default
+	checkAssembly(t, "OUT 1", cfg, []string{"1000000000001"}, "")
+	// Opcodes without a default still get zero
+	checkAssembly(t, "RET", cfg, []string{"0001000000000"}, "")
+}
+
+func TestByteOrderMark(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bom.asm")
+	if err := os.WriteFile(path, []byte("\uFEFFLOD R0 10\r\nRET\r\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	program, err := (&Assembler{Config: testConfig()}).AssembleFiles(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, word := range program.Words {
+		got = append(got, word.Bits())
+	}
+	if want := []string{"0110000001010", "0001000000000"}; !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMacroExpansionLimit(t *testing.T) {
+	var src strings.Builder
+	src.WriteString(".macro m0\nRET\n.endm\n")
+	for i := 1; i <= 22; i++ {
+		fmt.Fprintf(&src, ".macro m%d\nm%d\nm%d\n.endm\n", i, i-1, i-1)
+	}
+	src.WriteString("m22\n")
+	checkAssembly(t, src.String(), testConfig(), nil, "macros expand to more than 1048576 lines")
+}
+
+func TestDataDirectiveErrors(t *testing.T) {
+	tests := []struct {
+		src     string
+		wantErr string
+		source  string
+		column  int
+	}{
+		{".word 1, 99999", "decimal data out of range (0-8191): 99999", ".word 1, 99999", 10},
+		{".byte 'a', 256", "decimal data out of range (0-255): 256", ".byte 'a', 256", 12},
+		{"#table: .word 0x10,  x", "unknown symbol or invalid data: x", ".word 0x10,  x", 14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.src, func(t *testing.T) {
+			_, err := Assemble(strings.NewReader(tt.src), testConfig())
+			var errs AssemblyErrors
+			if !errors.As(err, &errs) || len(errs) != 1 {
+				t.Fatalf("got error %v, want a single AssemblyError", err)
+			}
+			if !strings.Contains(errs[0].Error(), tt.wantErr) {
+				t.Errorf("got %q, want it to contain %q", errs[0], tt.wantErr)
+			}
+			// The error shows the line as written, pointing at the value
+			if errs[0].Source != tt.source {
+				t.Errorf("got source %q, want %q", errs[0].Source, tt.source)
+			}
+			if errs[0].Column != tt.column {
+				t.Errorf("got column %d, want %d", errs[0].Column, tt.column)
+			}
+		})
+	}
+}
+
+func TestDataDirectiveSource(t *testing.T) {
+	program, err := Assemble(strings.NewReader(".word 1, 'a'"), testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []string{"1", "'a'"} {
+		source := program.Words[i].Source
+		if source.Text != ".word 1, 'a'" {
+			t.Errorf("word %d has source %q, want the whole line", i, source.Text)
+		}
+		if fields := source.Fields(); !slices.Equal(fields, []string{".word", want}) {
+			t.Errorf("word %d has fields %q, want .word %s", i, fields, want)
+		}
+	}
+}
+
+func TestDigitSeparators(t *testing.T) {
+	tests := []struct {
+		data    string
+		want    string
+		wantErr string
+	}{
+		{"1_0", "00001010", ""},
+		{"0b0000_1010", "00001010", ""},
+		{"0b_0000_1010", "00001010", ""},
+		{"0x_0A", "00001010", ""},
+		{"0o_1_2", "00001010", ""},
+		{"1__0", "", "misplaced digit separator: 1__0"},
+		{"10_", "", "misplaced digit separator: 10_"},
+		{"0x__A", "", "misplaced digit separator: 0x__A"},
+		{"0x_", "", "misplaced digit separator: 0x_"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.data, func(t *testing.T) {
+			var want []string
+			if tt.wantErr == "" {
+				want = []string{"0110" + "0" + tt.want}
+			}
+			checkAssembly(t, "LOD R0 "+tt.data, testConfig(), want, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package assembler
+
+import (
+	"errors"
+	"slices"
+	"strings"
+)
+
+// conditional is a block opened with .if and closed with .endif.
+type conditional struct {
+	outer  bool // Whether the lines around the block are assembled
+	value  bool // Whether the condition symbol is defined
+	inElse bool // Whether .else has been seen
+	file   string
+	line   int
+	text   string // The .if line
+}
+
+// active reports whether the lines in the current branch are assembled.
+func (c *conditional) active() bool {
+	return c.outer && c.value != c.inElse
+}
+
+// skipping reports whether the current line is inside a branch that isn't
+// assembled.
+func (p *parser) skipping() bool {
+	return len(p.conditionals) > 0 && !p.conditionals[len(p.conditionals)-1].active()
+}
+
+// parseConditional handles .if, .else and .endif, and reports whether the
+// line was used up by them, either as one of the directives or because it is
+// in a branch that is skipped.
+func (p *parser) parseConditional(line string) bool {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".if":
+		if len(fields) != 2 {
+			p.errorf(".if takes a single symbol: %s", line)
+		}
+		c := &conditional{outer: !p.skipping(), file: p.file, line: p.line, text: p.text}
+		if len(fields) == 2 {
+			c.value = slices.Contains(p.cfg.Defines, fields[1])
+		}
+		p.conditionals = append(p.conditionals, c)
+	case ".else":
+		if len(p.conditionals) == 0 {
+			p.errorf(".else without .if")
+			return true
+		}
+		c := p.conditionals[len(p.conditionals)-1]
+		if c.inElse {
+			p.errorf("second .else for the .if on %s", location(c.file, c.line))
+		}
+		c.inElse = true
+	case ".endif":
+		if len(p.conditionals) == 0 {
+			p.errorf(".endif without .if")
+			return true
+		}
+		p.conditionals = p.conditionals[:len(p.conditionals)-1]
+	default:
+		return p.skipping()
+	}
+	p.addDirective(line)
+	return true
+}
+
+// closeConditionals reports every block opened since depth that is still
+// open, and drops them.
+func (p *parser) closeConditionals(depth int) {
+	for _, c := range p.conditionals[depth:] {
+		p.errs = append(p.errs, AssemblyError{File: c.file, Line: c.line, Source: c.text, Err: errors.New(".if is never closed with .endif")})
+	}
+	p.conditionals = p.conditionals[:depth]
+}
@@ -0,0 +1,354 @@
+package assembler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	DefaultMemorySize  = 64
+	MaxMemorySize      = 1 << 24 // Most words of memory, which keeps the padded output in memory
+	DefaultDataWidth   = 8
+	MaxDataWidth       = 32
+	DefaultComment     = "//"
+	DefaultLabelPrefix = "#"
+)
+
+// Config describes the instruction set being assembled for.
+type Config struct {
+	Opcodes    map[string]string `json:"opcodes"`
+	Registers  map[string]string `json:"registers"`
+	MemorySize int               `json:"memory_size"`
+	DestWidth  int               `json:"dest_width"`
+	DataWidth  int               `json:"data_width"`
+	WordWidth  int               `json:"word_width"`
+
+	// CaseInsensitive makes mnemonics and register names match regardless
+	// of case
+	CaseInsensitive bool `json:"case_insensitive"`
+
+	// Comment starts a comment running to the end of the line
+	Comment string `json:"comment"`
+
+	// LabelPrefix marks both tag definitions and references to them
+	LabelPrefix string `json:"label_prefix"`
+
+	// Defines lists the symbols that are true in .if blocks
+	Defines []string `json:"defines"`
+
+	// Aliases maps extra mnemonics to the opcode they stand for, such as
+	// "MOV": "LOD"
+	Aliases map[string]string `json:"aliases"`
+
+	// OpcodeSpecs holds the settings of opcodes given as objects in the
+	// config rather than as bare bit strings. Their bits are still in Opcodes.
+	OpcodeSpecs map[string]OpcodeSpec `json:"-"`
+
+	opcodeNames *opcodeNames
+}
+
+// OpcodeSpec describes an opcode given as an object in the config, such as
+// "HLT": {"bits": "1111", "operands": "none"}.
+type OpcodeSpec struct {
+	Bits string `json:"bits"`
+
+	// Operands is the operands the opcode takes: none, dest, data or
+	// dest+data. Any operands are accepted when it is empty.
+	Operands string `json:"operands"`
+
+	// Dests lists the registers the opcode can target. Every register is
+	// allowed when it is empty.
+	Dests []string `json:"dests"`
+
+	// Data is the data used when the instruction doesn't give any, such as
+	// a function selector. It is zero when empty.
+	Data string `json:"data"`
+}
+
+// operandCounts is the number of operands each operand shape takes.
+var operandCounts = map[string]int{
+	"none":      0,
+	"dest":      1,
+	"data":      1,
+	"dest+data": 2,
+}
+
+// UnmarshalJSON decodes a config, accepting each opcode either as a bit string
+// or as an OpcodeSpec object.
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plainConfig Config
+	var raw struct {
+		plainConfig
+		Opcodes map[string]json.RawMessage `json:"opcodes"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*c = Config(raw.plainConfig)
+
+	if raw.Opcodes != nil {
+		c.Opcodes = make(map[string]string, len(raw.Opcodes))
+	}
+	for name, value := range raw.Opcodes {
+		var bits string
+		if err := json.Unmarshal(value, &bits); err == nil {
+			c.Opcodes[name] = bits
+			continue
+		}
+		var spec OpcodeSpec
+		if err := json.Unmarshal(value, &spec); err != nil {
+			return fmt.Errorf("opcode %s should be a bit string or an object: %w", name, err)
+		}
+		if c.OpcodeSpecs == nil {
+			c.OpcodeSpecs = make(map[string]OpcodeSpec)
+		}
+		c.Opcodes[name] = spec.Bits
+		c.OpcodeSpecs[name] = spec
+	}
+	return nil
+}
+
+// defaultRegisters are used when the config doesn't list any registers.
+var defaultRegisters = map[string]string{
+	"R0": "0",
+	"R1": "1",
+}
+
+// SetDefaults fills in the settings the config left out.
+func (c *Config) SetDefaults() {
+	if c.MemorySize == 0 {
+		c.MemorySize = DefaultMemorySize
+	}
+	if len(c.Registers) == 0 {
+		c.Registers = defaultRegisters
+	}
+	if c.DestWidth == 0 {
+		c.DestWidth = len(c.Registers[sortedKeys(c.Registers)[0]])
+	}
+	if c.DataWidth == 0 {
+		c.DataWidth = DefaultDataWidth
+	}
+	if c.Comment == "" {
+		c.Comment = DefaultComment
+	}
+	if c.LabelPrefix == "" {
+		c.LabelPrefix = DefaultLabelPrefix
+	}
+	if c.WordWidth == 0 && len(c.Opcodes) > 0 {
+		bits := c.Opcodes[sortedKeys(c.Opcodes)[0]]
+		c.WordWidth = len(bits) + c.DestWidth + c.DataWidth
+	}
+	// The opcodes are settled now, so their inverse can be cached
+	c.opcodeNames = &opcodeNames{}
+}
+
+// Validate checks that the registers and opcodes are well formed and add up
+// to a consistent word width.
+func (c Config) Validate() error {
+	if c.MemorySize < 0 {
+		return fmt.Errorf("invalid memory size: %d", c.MemorySize)
+	}
+	if c.MemorySize > MaxMemorySize {
+		return fmt.Errorf("memory size is more than %d words: %d", MaxMemorySize, c.MemorySize)
+	}
+
+	if c.DataWidth < 1 || c.DataWidth > MaxDataWidth {
+		return fmt.Errorf("data width should be between 1 and %d bits: %d", MaxDataWidth, c.DataWidth)
+	}
+
+	if err := c.validateLabelPrefix(); err != nil {
+		return err
+	}
+	if err := c.validateComment(); err != nil {
+		return err
+	}
+
+	for _, name := range c.Defines {
+		if !isIdentifier(name) {
+			return fmt.Errorf("invalid symbol name in defines: %q", name)
+		}
+	}
+
+	for _, name := range sortedKeys(c.Registers) {
+		bits := c.Registers[name]
+		if !isBinary(bits) {
+			return fmt.Errorf("register %s should be encoded as a binary string: %q", name, bits)
+		}
+		if len(bits) != c.DestWidth {
+			return fmt.Errorf("register %s is %d bits but the destination field is %d bits", name, len(bits), c.DestWidth)
+		}
+	}
+
+	if len(c.Opcodes) == 0 {
+		return errors.New("no opcodes defined")
+	}
+	if c.CaseInsensitive {
+		if err := checkCaseCollisions("opcodes", c.Opcodes); err != nil {
+			return err
+		}
+		if err := checkCaseCollisions("registers", c.Registers); err != nil {
+			return err
+		}
+	}
+	names := sortedKeys(c.Opcodes)
+	for _, name := range names {
+		bits := c.Opcodes[name]
+		if !isBinary(bits) {
+			return fmt.Errorf("opcode %s should be encoded as a binary string: %q", name, bits)
+		}
+		if first := c.Opcodes[names[0]]; len(bits) != len(first) {
+			return fmt.Errorf("opcodes should all be the same width: %s is %q but %s is %q", name, bits, names[0], first)
+		}
+	}
+
+	for _, name := range names {
+		if width := len(c.Opcodes[name]) + c.DestWidth + c.DataWidth; width != c.WordWidth {
+			return fmt.Errorf("opcode %s makes instructions %d bits long instead of %d", name, width, c.WordWidth)
+		}
+	}
+
+	for _, alias := range sortedKeys(c.Aliases) {
+		if _, ok := c.lookup(c.Opcodes, alias); ok {
+			return fmt.Errorf("alias %s has the same name as an opcode", alias)
+		}
+		if _, ok := c.Opcodes[c.Aliases[alias]]; !ok {
+			return fmt.Errorf("alias %s stands for unknown opcode %s", alias, c.Aliases[alias])
+		}
+	}
+	if c.CaseInsensitive {
+		if err := checkCaseCollisions("aliases", c.Aliases); err != nil {
+			return err
+		}
+	}
+
+	// Words using an encoding shared by two opcodes can't be read back
+	if _, err := c.OpcodeNames(); err != nil {
+		return err
+	}
+
+	for name, spec := range c.OpcodeSpecs {
+		if _, ok := c.Opcodes[name]; !ok {
+			return fmt.Errorf("settings given for unknown opcode %s", name)
+		}
+		if _, ok := operandCounts[spec.Operands]; spec.Operands != "" && !ok {
+			return fmt.Errorf("opcode %s has unknown operands %q, expected none, dest, data or dest+data", name, spec.Operands)
+		}
+		for _, register := range spec.Dests {
+			if _, ok := c.Registers[register]; !ok {
+				return fmt.Errorf("opcode %s can target unknown register %s", name, register)
+			}
+		}
+		if spec.Data != "" {
+			// Default data can't refer to anything in the source
+			noSymbols := &symbols{tags: map[string]*Tag{}, constants: map[string]*constant{}}
+			if _, err := c.processData(spec.Data, noSymbols, 0); err != nil {
+				return fmt.Errorf("invalid default data for opcode %s: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateComment makes sure the comment prefix can't be mistaken for the
+// start of a tag, directive or quoted literal.
+func (c Config) validateComment() error {
+	if strings.ContainsAny(c.Comment, " \t'\"") {
+		return fmt.Errorf("comment prefix can't contain whitespace or quotes: %q", c.Comment)
+	}
+	if c.isTag(c.Comment) || strings.HasPrefix(c.LabelPrefix, c.Comment) || isDirective(c.Comment) {
+		return fmt.Errorf("comment prefix %q collides with the label or directive prefix", c.Comment)
+	}
+	return nil
+}
+
+// validateLabelPrefix makes sure the label prefix can't be mistaken for the
+// start of a name, number, directive or quoted literal.
+func (c Config) validateLabelPrefix() error {
+	for _, r := range c.LabelPrefix {
+		if !unicode.IsPunct(r) && !unicode.IsSymbol(r) || strings.ContainsRune(".'\"_-+$", r) {
+			return fmt.Errorf("label prefix should only contain symbols other than . ' \" _ - + and $: %q", c.LabelPrefix)
+		}
+	}
+	return nil
+}
+
+// isTag reports whether s starts with the label prefix.
+func (c Config) isTag(s string) bool {
+	return strings.HasPrefix(s, c.LabelPrefix)
+}
+
+// lookup finds a mnemonic or register name in m, ignoring case if the config
+// asks for it.
+func (c Config) lookup(m map[string]string, name string) (string, bool) {
+	key, ok := c.canonical(m, name)
+	return m[key], ok
+}
+
+// opcodeName returns the opcode a mnemonic refers to, following aliases.
+func (c Config) opcodeName(mnemonic string) (string, bool) {
+	if name, ok := c.canonical(c.Opcodes, mnemonic); ok {
+		return name, true
+	}
+	return c.lookup(c.Aliases, mnemonic)
+}
+
+// canonical returns the key of m that name refers to, which only differs from
+// name in case.
+func (c Config) canonical(m map[string]string, name string) (string, bool) {
+	if _, ok := m[name]; ok || !c.CaseInsensitive {
+		return name, ok
+	}
+	for key := range m {
+		if strings.EqualFold(key, name) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// checkCaseCollisions makes sure no two names in m only differ in case, which
+// would make case insensitive lookups ambiguous.
+func checkCaseCollisions(kind string, m map[string]string) error {
+	seen := make(map[string]string)
+	for _, name := range sortedKeys(m) {
+		folded := strings.ToUpper(name)
+		if other, ok := seen[folded]; ok {
+			return fmt.Errorf("%s %s and %s only differ in case", kind, other, name)
+		}
+		seen[folded] = name
+	}
+	return nil
+}
+
+// maxData is the largest unsigned value that fits in the data field.
+func (c Config) maxData() int64 {
+	return 1<<c.DataWidth - 1
+}
+
+// minData is the smallest signed value that fits in the data field.
+func (c Config) minData() int64 {
+	return -(1 << (c.DataWidth - 1))
+}
+
+// formatData formats a value as a binary string the width of the data field.
+func (c Config) formatData(value int64) string {
+	return fmt.Sprintf("%0*b", c.DataWidth, value)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func isBinary(bits string) bool {
+	return bits != "" && strings.Trim(bits, "01") == ""
+}
@@ -0,0 +1,78 @@
+package assembler
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(*Config)
+		wantErr string
+	}{
+		{"default instruction set", func(*Config) {}, ""},
+		{"colliding opcodes", func(c *Config) {
+			c.Opcodes["SUB"] = "0100"
+		}, "duplicate opcode encodings: ADD, SUB share the encoding 0100"},
+		{"several collisions", func(c *Config) {
+			c.Opcodes["SUB"] = "0100"
+			c.Opcodes["OUT"] = "0111"
+		}, "ADD, SUB share the encoding 0100; INP, OUT share the encoding 0111"},
+		{"uneven opcodes", func(c *Config) {
+			c.Opcodes["RET"] = "01"
+		}, "opcodes should all be the same width"},
+		{"alias of an opcode name", func(c *Config) {
+			c.Aliases = map[string]string{"ADD": "SUB"}
+		}, "alias ADD has the same name as an opcode"},
+		{"alias of an unknown opcode", func(c *Config) {
+			c.Aliases = map[string]string{"JMP": "JUMP"}
+		}, "alias JMP stands for unknown opcode JUMP"},
+		{"unknown register in dests", func(c *Config) {
+			c.OpcodeSpecs = map[string]OpcodeSpec{"ADD": {Bits: "0100", Dests: []string{"R2"}}}
+		}, "opcode ADD can target unknown register R2"},
+		{"invalid default data", func(c *Config) {
+			c.OpcodeSpecs = map[string]OpcodeSpec{"OUT": {Bits: "1000", Data: "0x100"}}
+		}, "invalid default data for opcode OUT"},
+		{"memory size over the cap", func(c *Config) {
+			c.MemorySize = MaxMemorySize + 1
+		}, "memory size is more than 16777216 words"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			tt.change(&cfg)
+			cfg.SetDefaults()
+			err := cfg.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestWordWidths(t *testing.T) {
+	tests := []struct {
+		name      string
+		opcode    string
+		dataWidth int
+		src       string
+		want      string
+	}{
+		{"8 bit", "011", 4, "LOD R1 -1", "01111111"},
+		{"12 bit", "0110", 7, "LOD R1 5", "011010000101"},
+		{"16 bit", "0110000", 8, "LOD R1 'a'", "0110000101100001"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Config{Opcodes: map[string]string{"LOD": tt.opcode}, DataWidth: tt.dataWidth}
+			checkAssembly(t, tt.src, cfg, []string{tt.want}, "")
+		})
+	}
+}
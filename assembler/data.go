@@ -0,0 +1,282 @@
+package assembler
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// relativePrefix marks a tag reference that is encoded as the signed distance
+// from the next instruction, as in BRN $loop.
+const relativePrefix = "$"
+
+// processData encodes the data of the instruction at address.
+func (c Config) processData(data string, syms *symbols, address int) (string, error) {
+	if strings.HasPrefix(data, relativePrefix) {
+		return c.processRelative(data, syms.tags, address)
+	}
+	if isIdentifier(data) {
+		// A bare name can refer to a tag without its prefix
+		if _, ok := syms.tags[data]; ok {
+			return c.processTag(c.LabelPrefix+data, syms.tags)
+		}
+		constant, ok := syms.constants[data]
+		if !ok {
+			return "", fmt.Errorf("unknown symbol or invalid data: %s", data)
+		}
+		data = constant.value
+	}
+	if isExpression(data) && !c.isTagOffset(data) {
+		value, err := c.evaluate(data, syms)
+		if err != nil {
+			return "", err
+		}
+		return c.checkSigned(value, "expression", data)
+	}
+	if c.isTag(data) {
+		return c.processTag(data, syms.tags)
+	}
+	if strings.HasPrefix(data, "'") {
+		return c.processCharData(data)
+	}
+	return c.processBinOrDecData(data)
+}
+
+// processTag resolves a tag reference to its address. The reference can end
+// in an offset such as #loop+2 or #loop-1.
+func (c Config) processTag(data string, tags map[string]*Tag) (string, error) {
+	target, err := tagAddress(data[len(c.LabelPrefix):], tags)
+	if err != nil {
+		return "", err
+	}
+
+	address := int64(target)
+	if address < 0 || address > c.maxData() {
+		return "", fmt.Errorf("jump target out of range (0-%d): %s is at address %d", c.maxData(), data, address)
+	}
+	return c.formatData(address), nil
+}
+
+// processRelative resolves a $ tag reference to the distance from the
+// instruction after the one at address to the tag, as a signed value.
+func (c Config) processRelative(data string, tags map[string]*Tag, address int) (string, error) {
+	target, err := tagAddress(data[len(relativePrefix):], tags)
+	if err != nil {
+		return "", err
+	}
+
+	offset, maxOffset := int64(target-(address+1)), c.maxData()>>1
+	if offset < c.minData() || offset > maxOffset {
+		return "", fmt.Errorf("relative jump out of range (%d to %d): %s is %d words away", c.minData(), maxOffset, data, offset)
+	}
+	return c.formatData(offset & c.maxData()), nil
+}
+
+// tagAddress looks up the address of a tag reference without its prefix,
+// which can end in an offset, and marks the tag as referenced.
+func tagAddress(ref string, tags map[string]*Tag) (int, error) {
+	name, offset := ref, 0
+	if _, ok := tags[name]; !ok {
+		// Only look for an offset when the whole reference isn't a tag, so
+		// tags containing - still work
+		var err error
+		name, offset, err = splitTagOffset(name)
+		if err != nil {
+			return 0, err
+		}
+	}
+	tag, ok := tags[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown tag: %s", name)
+	}
+	tag.Referenced = true
+	return tag.Address + offset, nil
+}
+
+// isTagOffset reports whether data is a tag reference with an offset, which
+// processTag handles along with tag names containing operators.
+func (c Config) isTagOffset(data string) bool {
+	return c.isTag(data) && !strings.ContainsAny(data, "()*/")
+}
+
+func splitTagOffset(ref string) (name string, offset int, err error) {
+	i := strings.LastIndexAny(ref, "+-")
+	if i < 0 {
+		return ref, 0, nil
+	}
+	offset, err = strconv.Atoi(ref[i:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid tag offset: %s", ref)
+	}
+	return ref[:i], offset, nil
+}
+
+var charEscapes = map[string]rune{
+	`\n`: '\n',
+	`\t`: '\t',
+	`\0`: 0,
+	`\\`: '\\',
+	`\'`: '\'',
+}
+
+// processCharData converts a single quoted character literal such as 'A' or
+// '\n' to the binary string of its character code.
+func (c Config) processCharData(data string) (string, error) {
+	char, err := charValue(data)
+	if err != nil {
+		return "", err
+	}
+	return c.checkData(int64(char), "character", data)
+}
+
+// charValue decodes a single quoted character literal.
+func charValue(data string) (rune, error) {
+	if len(data) < 3 || !strings.HasSuffix(data, "'") {
+		return 0, fmt.Errorf("invalid character literal: %s", data)
+	}
+
+	body := data[1 : len(data)-1]
+	if strings.HasPrefix(body, `\`) {
+		escape, ok := charEscapes[body]
+		if !ok {
+			return 0, fmt.Errorf("unknown escape sequence in character literal: %s", data)
+		}
+		return escape, nil
+	}
+	r, size := utf8.DecodeRuneInString(body)
+	if size != len(body) {
+		return 0, fmt.Errorf("character literal should contain a single character: %s", data)
+	}
+	return r, nil
+}
+
+func (c Config) processBinOrDecData(data string) (string, error) {
+	digits, err := stripSeparators(data)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(digits, "0b") {
+		// Data is in binary format
+		bits := digits[2:]
+		if !isBinary(bits) {
+			return "", fmt.Errorf("binary data should only contain 0 and 1: %s", data)
+		}
+		if len(bits) != c.DataWidth {
+			return "", fmt.Errorf("binary data should be %d bits long: %s", c.DataWidth, data)
+		}
+		return bits, nil
+	}
+
+	if strings.HasPrefix(digits, "0x") {
+		// Data is in hexadecimal format
+		return c.processPrefixedData(digits, data, 16, "hex")
+	}
+
+	if strings.HasPrefix(digits, "0o") {
+		// Data is in octal format
+		return c.processPrefixedData(digits, data, 8, "octal")
+	}
+
+	// Data is in decimal format
+	decimal, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return "", fmt.Errorf("invalid decimal data: %s", data)
+	}
+	return c.checkSigned(decimal, "decimal", data)
+}
+
+// checkSigned is checkData for values that can also be negative, which are
+// encoded as two's complement.
+func (c Config) checkSigned(value int64, kind, data string) (string, error) {
+	if value < 0 {
+		if value < c.minData() {
+			return "", fmt.Errorf("negative %s data out of range (%d to -1): %s", kind, c.minData(), data)
+		}
+		return c.formatData(value & c.maxData()), nil
+	}
+	return c.checkData(value, kind, data)
+}
+
+// processPrefixedData parses digits with a two character base prefix such as
+// 0x or 0o into a binary string. data is the literal as written, for errors.
+func (c Config) processPrefixedData(digits, data string, base int, kind string) (string, error) {
+	value, err := strconv.ParseInt(digits[2:], base, 64)
+	if err != nil && !errors.Is(err, strconv.ErrRange) {
+		return "", fmt.Errorf("invalid %s data: %s", kind, data)
+	}
+	if value < 0 {
+		return "", fmt.Errorf("invalid %s data: %s", kind, data)
+	}
+	return c.checkData(value, kind, data)
+}
+
+// checkData checks that a parsed value fits in the data field and formats it
+// as a binary string. Values that overflowed int64 while parsing arrive
+// clamped and are rejected here as well.
+func (c Config) checkData(value int64, kind, data string) (string, error) {
+	if value < 0 || value > c.maxData() {
+		return "", fmt.Errorf("%s data out of range (0-%d): %s", kind, c.maxData(), data)
+	}
+	return c.formatData(value), nil
+}
+
+// parseInteger parses a decimal, 0b binary, 0o octal or 0x hex number.
+func parseInteger(s string) (int64, error) {
+	s, err := stripSeparators(s)
+	if err != nil {
+		return 0, err
+	}
+	base := 10
+	digits := s
+	switch {
+	case strings.HasPrefix(s, "0b"):
+		base, digits = 2, s[2:]
+	case strings.HasPrefix(s, "0o"):
+		base, digits = 8, s[2:]
+	case strings.HasPrefix(s, "0x"):
+		base, digits = 16, s[2:]
+	}
+	return strconv.ParseInt(digits, base, 64)
+}
+
+// stripSeparators removes the underscores used to group digits, as in
+// 0b1011_0010 or 1_000. Like in Go, each underscore has to sit between two
+// digits or straight after a base prefix, as in 0x_FF.
+func stripSeparators(literal string) (string, error) {
+	if !strings.Contains(literal, "_") {
+		return literal, nil
+	}
+	prefixed := strings.HasPrefix(literal, "0b") || strings.HasPrefix(literal, "0o") || strings.HasPrefix(literal, "0x")
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '_' {
+			continue
+		}
+		afterDigit := i > 0 && isDigitChar(literal[i-1]) || i == 2 && prefixed
+		if !afterDigit || i == len(literal)-1 || !isDigitChar(literal[i+1]) {
+			return "", fmt.Errorf("misplaced digit separator: %s", literal)
+		}
+	}
+	return strings.ReplaceAll(literal, "_", ""), nil
+}
+
+// isDigitChar reports whether c can be a digit in any supported base.
+func isDigitChar(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+// isIdentifier reports whether s can be used as a constant name.
+func isIdentifier(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
+}
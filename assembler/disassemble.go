@@ -0,0 +1,152 @@
+package assembler
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Disassemble turns 16 bit words, such as those from AssembleString, back
+// into one instruction per word. Words that don't decode to an instruction
+// that assembles back to them, such as those with an unknown opcode, are
+// written as .word with their value in hex.
+func Disassemble(words []uint16, cfg Config) ([]string, error) {
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	if _, err := cfg.OpcodeNames(); err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, len(words))
+	for i, word := range words {
+		line, err := cfg.DisassembleWord(uint64(word))
+		if err != nil {
+			return nil, fmt.Errorf("address %d: %w", i, err)
+		}
+		lines[i] = line
+	}
+	return lines, nil
+}
+
+// RoundTrip assembles src, disassembles the words and assembles the result
+// again, returning an error for the first word that comes out different. It
+// checks that a config's words decode to instructions that encode them, and
+// that the disassembler picks forms, such as decimal data, that keep the bits.
+func RoundTrip(src string, cfg Config) error {
+	program, err := Assemble(strings.NewReader(src), cfg)
+	if err != nil {
+		return err
+	}
+	cfg.SetDefaults()
+
+	lines := make([]string, len(program.Words))
+	for i, word := range program.Words {
+		value, err := word.Value()
+		if err != nil {
+			return fmt.Errorf("%s: %w", word.Source.Location(), err)
+		}
+		if lines[i], err = cfg.DisassembleWord(value); err != nil {
+			return fmt.Errorf("%s: %w", word.Source.Location(), err)
+		}
+	}
+
+	again, err := Assemble(strings.NewReader(strings.Join(lines, "\n")), cfg)
+	if err != nil {
+		return fmt.Errorf("reassembling disassembled words: %w", err)
+	}
+	if len(again.Words) != len(program.Words) {
+		return fmt.Errorf("%d words disassemble to %d", len(program.Words), len(again.Words))
+	}
+	for i, word := range program.Words {
+		if bits := again.Words[i].Bits(); bits != word.Bits() {
+			return fmt.Errorf("%s: %s disassembles to %s, which assembles to %s", word.Source.Location(), word.Bits(), lines[i], bits)
+		}
+	}
+	return nil
+}
+
+// DisassembleWord turns a machine word back into an instruction, split into
+// its fields with the configured widths. The destination and data are left
+// out when the opcode allows it and they are zero or the opcode's default
+// data. A word that doesn't decode to an instruction assembling back to it
+// is written as .word. It is an error for the word to be wider than
+// WordWidth. The config should have had SetDefaults called.
+func (c Config) DisassembleWord(word uint64) (string, error) {
+	bits := fmt.Sprintf("%0*b", c.WordWidth, word)
+	if len(bits) > c.WordWidth {
+		return "", fmt.Errorf("word 0x%X is wider than %d bits", word, c.WordWidth)
+	}
+	raw := fmt.Sprintf(".word 0x%0*X", (c.WordWidth+3)/4, word)
+
+	opcodeWidth := c.WordWidth - c.DestWidth - c.DataWidth
+	opcode := bits[:opcodeWidth]
+	dest := bits[opcodeWidth : opcodeWidth+c.DestWidth]
+	data := bits[opcodeWidth+c.DestWidth:]
+
+	names, _ := c.OpcodeNames()
+	name, ok := names[opcode]
+	if !ok {
+		return raw, nil
+	}
+	spec := c.OpcodeSpecs[name]
+
+	defaultData := strings.Repeat("0", c.DataWidth)
+	if spec.Data != "" {
+		noSymbols := &symbols{tags: map[string]*Tag{}, constants: map[string]*constant{}}
+		defaultData, _ = c.processData(spec.Data, noSymbols, 0)
+	}
+	value, _ := strconv.ParseUint(data, 2, 64)
+
+	zeroDest := strings.Trim(dest, "0") == ""
+	register, registerOK := c.registerName(spec, dest)
+	parts := []string{name}
+	switch spec.Operands {
+	case "none":
+		if !zeroDest || data != defaultData {
+			return raw, nil
+		}
+	case "dest":
+		if !registerOK || data != defaultData {
+			return raw, nil
+		}
+		parts = append(parts, register)
+	case "data":
+		if !zeroDest {
+			return raw, nil
+		}
+		parts = append(parts, strconv.FormatUint(value, 10))
+	case "dest+data":
+		if !registerOK {
+			return raw, nil
+		}
+		parts = append(parts, register, strconv.FormatUint(value, 10))
+	default:
+		if !zeroDest {
+			if !registerOK {
+				return raw, nil
+			}
+			parts = append(parts, register)
+		}
+		if data != defaultData {
+			parts = append(parts, strconv.FormatUint(value, 10))
+		}
+	}
+	return strings.Join(parts, " "), nil
+}
+
+// registerName finds the register the opcode can target that dest encodes,
+// picking the alphabetically first if there are several.
+func (c Config) registerName(spec OpcodeSpec, dest string) (string, bool) {
+	for _, name := range sortedKeys(c.Registers) {
+		if c.Registers[name] != dest {
+			continue
+		}
+		if len(spec.Dests) == 0 || slices.Contains(spec.Dests, name) {
+			return name, true
+		}
+	}
+	return "", false
+}
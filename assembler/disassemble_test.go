@@ -0,0 +1,47 @@
+package assembler
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	sample, err := os.ReadFile("../programs/test.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"sample program", string(sample)},
+		{"literal forms", "LOD R1 0x0F\nLOD R0 -1\nLOD R1 'a'\nADD R0 0b1010_1010"},
+		{"data words", ".word 0x1FFF\n.byte 3\n.bits 1111111111111"},
+		{"relative jump", "#loop: SUB R0 1\nBRZ R0 $loop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := RoundTrip(tt.src, testConfig()); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	words, err := AssembleString("LOD R0 10\nSUB R1 1\nRET\n.word 0x1F00", testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Disassemble(words, testConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 0x1F00 has an opcode that isn't in the table
+	want := []string{"LOD 10", "SUB R1 1", "RET", ".word 0x1F00"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Disassemble() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,97 @@
+package assembler
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrTooManyErrors is joined with the errors returned when assembly stops
+// early because there are more than Assembler.MaxErrors of them.
+var ErrTooManyErrors = errors.New("too many errors, aborting")
+
+// AssemblyError is a problem found in the source.
+type AssemblyError struct {
+	File   string // File the problem is in, empty for source that isn't a file
+	Line   int    // Line the problem is on, 0 if it isn't tied to a line
+	Source string // Text of the line
+	Column int    // Column in Source of the token at fault, starting at 1, 0 if there isn't one
+	Err    error
+}
+
+// Location describes where the problem is in the source.
+func (e AssemblyError) Location() string {
+	return location(e.File, e.Line)
+}
+
+func (e AssemblyError) Error() string {
+	if e.Line == 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s: %s", e.Location(), e.Err)
+}
+
+func (e AssemblyError) Unwrap() error {
+	return e.Err
+}
+
+// AssemblyErrors is every problem found while assembling, in the order they
+// were found. Assemble returns one whenever the source has problems, which
+// callers can get at with errors.As.
+type AssemblyErrors []AssemblyError
+
+func (e AssemblyErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Sorted returns the errors ordered by file and line, with files in the order
+// they were first seen and repeated errors left out.
+func (e AssemblyErrors) Sorted() AssemblyErrors {
+	files := make(map[string]int)
+	seen := make(map[string]bool)
+	var sorted AssemblyErrors
+	for _, err := range e {
+		if _, ok := files[err.File]; !ok {
+			files[err.File] = len(files)
+		}
+		if message := err.Error(); !seen[message] {
+			seen[message] = true
+			sorted = append(sorted, err)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if a, b := files[sorted[i].File], files[sorted[j].File]; a != b {
+			return a < b
+		}
+		return sorted[i].Line < sorted[j].Line
+	})
+	return sorted
+}
+
+func (e AssemblyErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// tokenError is an error caused by a single token of an instruction, such as
+// an unknown register, so the error can point at it.
+type tokenError struct {
+	token int // Index of the token in the instruction, 0 being the mnemonic
+	err   error
+}
+
+func (e tokenError) Error() string {
+	return e.err.Error()
+}
+
+func (e tokenError) Unwrap() error {
+	return e.err
+}
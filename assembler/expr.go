@@ -0,0 +1,268 @@
+package assembler
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// maxConstantDepth is how deeply constants can be defined in terms of other
+// constants inside expressions, which catches constants defined in terms of
+// themselves.
+const maxConstantDepth = 64
+
+// isExpression reports whether data is more than a single literal, name or
+// tag reference, ignoring anything inside a character literal. A leading minus
+// is part of a negative number rather than an operator.
+func isExpression(data string) bool {
+	quoted := false
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '\\' && quoted:
+			i++
+		case c == '\'':
+			quoted = !quoted
+		case quoted:
+		case strings.IndexByte("()*/", c) >= 0:
+			return true
+		case (c == '+' || c == '-') && i > 0:
+			return true
+		}
+	}
+	return false
+}
+
+// evaluator evaluates an arithmetic expression over numbers, character
+// literals, constants and tags. Multiplication and division bind tighter than
+// addition and subtraction, operators of the same precedence are applied left
+// to right, and parentheses group as usual. Division truncates towards zero.
+type evaluator struct {
+	cfg   Config
+	syms  *symbols
+	expr  string
+	pos   int
+	depth int // Number of constants being expanded
+}
+
+func (c Config) evaluate(expr string, syms *symbols) (int64, error) {
+	return (&evaluator{cfg: c, syms: syms, expr: expr}).run()
+}
+
+func (e *evaluator) run() (int64, error) {
+	value, err := e.sum()
+	if err != nil {
+		return 0, err
+	}
+	if e.skipSpace(); e.pos < len(e.expr) {
+		return 0, fmt.Errorf("unexpected %q in expression: %s", e.expr[e.pos:], e.expr)
+	}
+	return value, nil
+}
+
+func (e *evaluator) sum() (int64, error) {
+	value, err := e.product()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch e.peek() {
+		case '+':
+			e.pos++
+			rhs, err := e.product()
+			if err != nil {
+				return 0, err
+			}
+			if value, err = e.add(value, rhs); err != nil {
+				return 0, err
+			}
+		case '-':
+			e.pos++
+			rhs, err := e.product()
+			if err != nil {
+				return 0, err
+			}
+			if rhs == math.MinInt64 {
+				return 0, e.overflow()
+			}
+			if value, err = e.add(value, -rhs); err != nil {
+				return 0, err
+			}
+		default:
+			return value, nil
+		}
+	}
+}
+
+func (e *evaluator) product() (int64, error) {
+	value, err := e.unary()
+	if err != nil {
+		return 0, err
+	}
+	for {
+		switch e.peek() {
+		case '*':
+			e.pos++
+			rhs, err := e.unary()
+			if err != nil {
+				return 0, err
+			}
+			if value, err = e.multiply(value, rhs); err != nil {
+				return 0, err
+			}
+		case '/':
+			e.pos++
+			rhs, err := e.unary()
+			if err != nil {
+				return 0, err
+			}
+			if rhs == 0 {
+				return 0, fmt.Errorf("division by zero in expression: %s", e.expr)
+			}
+			if value == math.MinInt64 && rhs == -1 {
+				return 0, e.overflow()
+			}
+			value /= rhs
+		default:
+			return value, nil
+		}
+	}
+}
+
+// add and multiply report results that don't fit in 64 bits, which would
+// otherwise wrap around to a value that could pass the range check.
+func (e *evaluator) add(a, b int64) (int64, error) {
+	if b > 0 && a > math.MaxInt64-b || b < 0 && a < math.MinInt64-b {
+		return 0, e.overflow()
+	}
+	return a + b, nil
+}
+
+func (e *evaluator) multiply(a, b int64) (int64, error) {
+	if a == 0 || b == 0 {
+		return 0, nil
+	}
+	product := a * b
+	if product/b != a || a == -1 && b == math.MinInt64 || b == -1 && a == math.MinInt64 {
+		return 0, e.overflow()
+	}
+	return product, nil
+}
+
+func (e *evaluator) overflow() error {
+	return fmt.Errorf("expression overflows 64 bits: %s", e.expr)
+}
+
+func (e *evaluator) unary() (int64, error) {
+	if e.peek() == '-' {
+		e.pos++
+		value, err := e.unary()
+		if err == nil && value == math.MinInt64 {
+			return 0, e.overflow()
+		}
+		return -value, err
+	}
+	return e.operand()
+}
+
+func (e *evaluator) operand() (int64, error) {
+	switch c := e.peek(); {
+	case c == '(':
+		e.pos++
+		value, err := e.sum()
+		if err != nil {
+			return 0, err
+		}
+		if e.peek() != ')' {
+			return 0, fmt.Errorf("missing ) in expression: %s", e.expr)
+		}
+		e.pos++
+		return value, nil
+	case c == '\'':
+		return e.char()
+	case e.cfg.isTag(e.expr[e.pos:]):
+		e.pos += len(e.cfg.LabelPrefix)
+		name := e.word()
+		tag, ok := e.syms.tags[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown tag: %s", name)
+		}
+		tag.Referenced = true
+		return int64(tag.Address), nil
+	case c >= '0' && c <= '9':
+		literal := e.word()
+		value, err := parseInteger(literal)
+		if err != nil {
+			return 0, fmt.Errorf("invalid number in expression: %s", literal)
+		}
+		return value, nil
+	case c == '_' || unicode.IsLetter(rune(c)):
+		return e.name(e.word())
+	case c == 0:
+		return 0, fmt.Errorf("expression ends early: %s", e.expr)
+	default:
+		return 0, fmt.Errorf("unexpected %q in expression: %s", c, e.expr)
+	}
+}
+
+// name resolves a constant, or failing that a tag without its prefix.
+func (e *evaluator) name(name string) (int64, error) {
+	if constant, ok := e.syms.constants[name]; ok {
+		if e.depth == maxConstantDepth {
+			return 0, fmt.Errorf("constant %s is defined in terms of itself", name)
+		}
+		inner := &evaluator{cfg: e.cfg, syms: e.syms, expr: constant.value, depth: e.depth + 1}
+		return inner.run()
+	}
+	if tag, ok := e.syms.tags[name]; ok {
+		tag.Referenced = true
+		return int64(tag.Address), nil
+	}
+	return 0, fmt.Errorf("undefined constant: %s", name)
+}
+
+func (e *evaluator) char() (int64, error) {
+	end := e.pos + 1
+	for end < len(e.expr) && e.expr[end] != '\'' {
+		if e.expr[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(e.expr) {
+		return 0, fmt.Errorf("invalid character literal in expression: %s", e.expr)
+	}
+	literal := e.expr[e.pos : end+1]
+	e.pos = end + 1
+	char, err := charValue(literal)
+	return int64(char), err
+}
+
+// word reads a run of letters, digits and underscores.
+func (e *evaluator) word() string {
+	start := e.pos
+	for e.pos < len(e.expr) {
+		r := rune(e.expr[e.pos])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		e.pos++
+	}
+	return e.expr[start:e.pos]
+}
+
+// peek skips whitespace and returns the next character, or 0 at the end of
+// the expression.
+func (e *evaluator) peek() byte {
+	e.skipSpace()
+	if e.pos >= len(e.expr) {
+		return 0
+	}
+	return e.expr[e.pos]
+}
+
+func (e *evaluator) skipSpace() {
+	for e.pos < len(e.expr) && e.expr[e.pos] == ' ' {
+		e.pos++
+	}
+}
@@ -0,0 +1,154 @@
+package assembler
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// minIndent is the narrowest column instructions are indented to.
+const minIndent = 8
+
+// formatLine is a source line split into the parts that are lined up.
+type formatLine struct {
+	verbatim  bool   // Whether the line is kept as it is in text
+	text      string // Line touching a block comment
+	label     string // Tag definition, flush left
+	mnemonic  string // Mnemonic, directive or macro name
+	operands  string
+	comment   string
+	indented  bool // Whether a line holding only a comment was indented
+	codeWidth int
+}
+
+// Format rewrites source in a canonical layout: tags flush left, mnemonics
+// and directives in one column, operands in the next and trailing comments
+// lined up after the longest line of code. Operands are separated by single
+// spaces and everything else is left as it is, so the source assembles to
+// the same words. Formatting formatted source doesn't change it, and lines
+// touching a block comment or with an operand left empty by a stray comma are
+// kept as they are. Lines end in LF, and a byte order mark at the start is
+// kept.
+func Format(src io.Reader, cfg Config) (string, error) {
+	p := newParser(cfg, "")
+	var lines []formatLine
+	scanner := bufio.NewScanner(src)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+	bom := false
+	for scanner.Scan() {
+		p.line++
+		raw := strings.TrimSuffix(scanner.Text(), "\r")
+		if p.line == 1 {
+			bom = strings.HasPrefix(raw, byteOrderMark)
+			raw = stripBOM(raw)
+		}
+		inComment := p.commentLine != 0
+		if p.stripBlockComments(raw) != raw || inComment || p.commentLine != 0 {
+			lines = append(lines, formatLine{verbatim: true, text: strings.TrimRight(raw, " \t")})
+			continue
+		}
+		lines = append(lines, cfg.splitFormatLine(raw))
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading source: %w", err)
+	}
+
+	indent, mnemonicWidth := minIndent, 0
+	for _, line := range lines {
+		if line.label != "" && line.mnemonic != "" {
+			indent = max(indent, len(line.label)+1)
+		}
+		if line.operands != "" {
+			mnemonicWidth = max(mnemonicWidth, len(line.mnemonic))
+		}
+	}
+
+	commentColumn := 0
+	for i := range lines {
+		line := &lines[i]
+		line.codeWidth = len(line.code(indent, mnemonicWidth))
+		if line.codeWidth > 0 && line.comment != "" {
+			commentColumn = max(commentColumn, line.codeWidth+1)
+		}
+	}
+
+	var formatted strings.Builder
+	if bom {
+		formatted.WriteString(byteOrderMark)
+	}
+	for _, line := range lines {
+		formatted.WriteString(line.format(indent, mnemonicWidth, commentColumn))
+		formatted.WriteByte('\n')
+	}
+	return formatted.String(), nil
+}
+
+// splitFormatLine splits a line into its tag, mnemonic, operands and
+// comment.
+func (c Config) splitFormatLine(raw string) formatLine {
+	trimmed := strings.TrimSpace(raw)
+	code, comment := trimmed, ""
+	if i := commentIndex(trimmed, c.Comment); i >= 0 {
+		code, comment = strings.TrimSpace(trimmed[:i]), trimmed[i:]
+	}
+	line := formatLine{comment: comment}
+	if code == "" {
+		line.indented = strings.TrimLeftFunc(raw, unicode.IsSpace) != raw
+		return line
+	}
+
+	if c.isTag(code) {
+		name, rest := splitTag(code[len(c.LabelPrefix):])
+		if rest == "" {
+			line.label = code
+			return line
+		}
+		line.label = c.LabelPrefix + name + ":"
+		code = rest
+	}
+
+	parts, empty := splitOperandList(code)
+	if empty >= 0 && !isDirective(code) {
+		// Dropping the empty operand would make a line that fails to
+		// assemble assemble
+		return formatLine{verbatim: true, text: strings.TrimRight(raw, " \t")}
+	}
+	line.mnemonic = parts[0]
+	if isDirective(code) {
+		// Directive arguments can hold spaces, as in .word ' ', so they are
+		// kept as written
+		line.operands = strings.TrimSpace(code[len(parts[0]):])
+	} else {
+		line.operands = strings.Join(parts[1:], " ")
+	}
+	return line
+}
+
+// code returns the line without its comment.
+func (l formatLine) code(indent, mnemonicWidth int) string {
+	if l.verbatim || l.mnemonic == "" {
+		return l.label
+	}
+	code := fmt.Sprintf("%-*s%s", indent, l.label, l.mnemonic)
+	if l.operands != "" {
+		code = fmt.Sprintf("%-*s%-*s %s", indent, l.label, mnemonicWidth, l.mnemonic, l.operands)
+	}
+	return code
+}
+
+func (l formatLine) format(indent, mnemonicWidth, commentColumn int) string {
+	switch {
+	case l.verbatim:
+		return l.text
+	case l.comment == "":
+		return l.code(indent, mnemonicWidth)
+	case l.codeWidth > 0:
+		return fmt.Sprintf("%-*s%s", commentColumn, l.code(indent, mnemonicWidth), l.comment)
+	case l.indented:
+		return strings.Repeat(" ", indent) + l.comment
+	default:
+		return l.comment
+	}
+}
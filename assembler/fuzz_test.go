@@ -0,0 +1,45 @@
+package assembler
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// FuzzAssemble checks that no source makes Assemble or Format panic, and that
+// source that assembles assembles to the same words once formatted.
+func FuzzAssemble(f *testing.F) {
+	for _, src := range []string{
+		"LOD R0 1",
+		"#loop: SUB R0, 1\nBRZ R0 $loop",
+		".word 'a', 0x10\n.byte -1",
+		".macro m\nLOD R0 %1\n.endm\nm 3",
+		".if X\nRET\n.else\nOUT 1\n.endif",
+		".equ A 2\nLOD R0 (A+1)*3",
+		"/* a\nblock */ LOD R0 0b1_0 // comment",
+		".org 4\n.align 8\n.bits 0000000000000",
+		"\uFEFFRET\r\n",
+		",,,\n#:\n'",
+	} {
+		f.Add(src)
+	}
+
+	cfg := testConfig()
+	f.Fuzz(func(t *testing.T, src string) {
+		program, err := Assemble(strings.NewReader(src), cfg)
+		formatted, formatErr := Format(strings.NewReader(src), cfg)
+		if err != nil || formatErr != nil {
+			return
+		}
+
+		again, err := Assemble(strings.NewReader(formatted), cfg)
+		if err != nil {
+			t.Fatalf("formatted source fails to assemble: %v\nsource:\n%s\nformatted:\n%s", err, src, formatted)
+		}
+		if !slices.EqualFunc(program.Words, again.Words, func(a, b Word) bool {
+			return a.Bits() == b.Bits() && a.Source.Address == b.Source.Address
+		}) {
+			t.Fatalf("formatted source assembles to different words\nsource:\n%s\nformatted:\n%s", src, formatted)
+		}
+	})
+}
@@ -0,0 +1,58 @@
+package assembler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// opcodeNames caches the inverse of an opcode table. It is shared between
+// copies of a Config made after SetDefaults.
+type opcodeNames struct {
+	once  sync.Once
+	names map[string]string
+	err   error
+}
+
+// OpcodeNames maps each opcode encoding back to its mnemonic, for turning
+// words back into instructions. The map is built once after SetDefaults and
+// shared, so it must not be modified.
+//
+// Two mnemonics with the same encoding make the error non-nil, naming every
+// collision. The map is still returned in that case, with the alphabetically
+// first of the colliding mnemonics.
+func (c Config) OpcodeNames() (map[string]string, error) {
+	if c.opcodeNames == nil {
+		return invertOpcodes(c.Opcodes)
+	}
+	cache := c.opcodeNames
+	cache.once.Do(func() {
+		cache.names, cache.err = invertOpcodes(c.Opcodes)
+	})
+	return cache.names, cache.err
+}
+
+func invertOpcodes(opcodes map[string]string) (map[string]string, error) {
+	names := make(map[string]string, len(opcodes))
+	shared := make(map[string][]string)
+	for _, name := range sortedKeys(opcodes) {
+		bits := opcodes[name]
+		if _, ok := names[bits]; !ok {
+			names[bits] = name
+		}
+		shared[bits] = append(shared[bits], name)
+	}
+
+	var collisions []string
+	for bits, mnemonics := range shared {
+		if len(mnemonics) > 1 {
+			collisions = append(collisions, fmt.Sprintf("%s share the encoding %s", strings.Join(mnemonics, ", "), bits))
+		}
+	}
+	if len(collisions) > 0 {
+		sort.Strings(collisions)
+		return names, fmt.Errorf("duplicate opcode encodings: %s", strings.Join(collisions, "; "))
+	}
+	return names, nil
+}
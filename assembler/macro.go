@@ -0,0 +1,138 @@
+package assembler
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// macro is a block of lines defined with .macro and .endm that is expanded
+// wherever its name is used as an instruction.
+type macro struct {
+	name   string
+	body   []string
+	params int // Highest %N parameter used in the body
+	file   string
+	line   int
+	text   string // The .macro line
+}
+
+// location describes where the macro is defined.
+func (m *macro) location() string {
+	return location(m.file, m.line)
+}
+
+// defineMacro starts recording the body of a macro, which runs until the next
+// .endm.
+func (p *parser) defineMacro(fields []string) error {
+	if len(fields) != 2 {
+		return fmt.Errorf(".macro takes a single name: %s", strings.Join(fields, " "))
+	}
+	name := fields[1]
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid macro name: %s", name)
+	}
+	if _, ok := p.cfg.opcodeName(name); ok {
+		return fmt.Errorf("macro %s has the same name as an opcode", name)
+	}
+	if existing, ok := p.macros[name]; ok {
+		return fmt.Errorf("macro %s is already defined on %s", name, existing.location())
+	}
+	p.defining = &macro{name: name, file: p.file, line: p.line, text: p.text}
+	return nil
+}
+
+// recordMacroLine adds a line to the body of the macro being defined, or
+// finishes it at .endm.
+func (p *parser) recordMacroLine(line string) {
+	m := p.defining
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".endm":
+		p.macros[m.name] = m
+		p.defining = nil
+		p.addDirective(line)
+		return
+	case ".macro":
+		p.errorf("macro %s can't be defined inside macro %s", strings.Join(fields[1:], " "), m.name)
+		return
+	}
+
+	for i := 0; i < len(line); i++ {
+		if line[i] == '%' {
+			if n, err := strconv.Atoi(line[i+1 : digitsEnd(line, i+1)]); err == nil {
+				m.params = max(m.params, n)
+			}
+		}
+	}
+	m.body = append(m.body, line)
+}
+
+// maxExpandedLines is the most lines macros can expand to in a program. Macros
+// using each other can double the lines at every level, which would otherwise
+// let a short file take up all the memory.
+const maxExpandedLines = 1 << 20
+
+// expandMacro parses the body of a macro in place of the line using it, with
+// %1, %2 and so on replaced by the arguments.
+func (p *parser) expandMacro(m *macro, args []string) {
+	if len(args) != m.params {
+		p.errorf("macro %s takes %d %s but is given %d", m.name, m.params, plural(m.params, "argument"), len(args))
+		return
+	}
+	if slices.Contains(p.expanding, m.name) {
+		p.errorf("macro %s expands itself", m.name)
+		return
+	}
+
+	p.expanding = append(p.expanding, m.name)
+	depth := len(p.conditionals)
+	for _, line := range m.body {
+		if p.expanded > maxExpandedLines {
+			// Already reported
+			break
+		}
+		p.expanded++
+		if p.expanded > maxExpandedLines {
+			p.errorf("macros expand to more than %d lines", maxExpandedLines)
+			break
+		}
+		p.parseLine(substituteParams(line, args))
+	}
+	p.closeConditionals(depth)
+	p.expanding = p.expanding[:len(p.expanding)-1]
+}
+
+// substituteParams replaces every %N in line with the Nth argument.
+func substituteParams(line string, args []string) string {
+	var expanded strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] == '%' {
+			end := digitsEnd(line, i+1)
+			if n, err := strconv.Atoi(line[i+1 : end]); err == nil && n >= 1 && n <= len(args) {
+				expanded.WriteString(args[n-1])
+				i = end - 1
+				continue
+			}
+		}
+		expanded.WriteByte(line[i])
+	}
+	return expanded.String()
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
+
+// digitsEnd returns the index just past the run of digits starting at start.
+func digitsEnd(s string, start int) int {
+	end := start
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	return end
+}
@@ -0,0 +1,554 @@
+package assembler
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// parser holds the state built up while reading source line by line.
+type parser struct {
+	cfg          Config
+	syms         *symbols
+	used         map[int]string // Location of the instruction at each address
+	instructions []Instruction
+	directives   []Instruction // Lines that don't place a word, at the address they apply at
+	errs         AssemblyErrors
+	strict       []string // Problems only reported in strict mode
+	address      int      // Address of the next instruction
+	line         int      // Current source line
+	text         string   // Text of the current source line
+	file         string   // File being read, empty for source that isn't a file
+	dir          string   // Directory includes are resolved relative to
+	including    []string // Absolute paths of the files being read, to catch cycles
+	files        []string // Every file the source tried to read, in order
+	macros       map[string]*macro
+	defining     *macro         // Macro whose body is being read
+	expanding    []string       // Names of the macros being expanded, to catch recursion
+	expanded     int            // Lines parsed from macro bodies so far
+	conditionals []*conditional // .if blocks that are open, innermost last
+	commentLine  int            // Line the open block comment starts on, 0 when there is none
+	commentText  string         // Text of that line
+}
+
+func newParser(cfg Config, filename string) *parser {
+	p := &parser{
+		cfg: cfg,
+		syms: &symbols{
+			tags:      make(map[string]*Tag),
+			constants: make(map[string]*constant),
+		},
+		used:   make(map[int]string),
+		dir:    filepath.Dir(filename),
+		macros: make(map[string]*macro),
+	}
+	if filename != "" {
+		if path, err := filepath.Abs(filename); err == nil {
+			p.including = append(p.including, path)
+		}
+	}
+	return p
+}
+
+// parse reads the main source. filename is only used to resolve includes
+// and may be empty, in which case includes are relative to the working
+// directory.
+func parse(cfg Config, r io.Reader, filename string) *parser {
+	p := newParser(cfg, filename)
+	p.parseSource(r)
+	return p
+}
+
+// parseFiles reads several files one after the other as a single program.
+// Tags and constants defined in one file can be used in the others.
+func parseFiles(cfg Config, paths []string) *parser {
+	p := newParser(cfg, "")
+	for _, path := range paths {
+		if err := p.include(path); err != nil {
+			p.errs = append(p.errs, AssemblyError{File: path, Err: err})
+		}
+	}
+	return p
+}
+
+// maxLineLength is the longest source line the parser accepts, in bytes.
+const maxLineLength = 64 * 1024
+
+// maxAddress is the highest address .org and .align can move to, which keeps
+// address arithmetic from overflowing.
+const maxAddress = 1<<31 - 1
+
+func (p *parser) parseSource(r io.Reader) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineLength)
+	depth := len(p.conditionals) // Blocks have to be closed in the file opening them
+
+	first := p.line + 1
+	for scanner.Scan() {
+		p.line++
+		p.text = strings.TrimSuffix(scanner.Text(), "\r")
+		if p.line == first {
+			p.text = stripBOM(p.text)
+		}
+		if !utf8.ValidString(p.text) {
+			p.errorf("line is not valid UTF-8")
+			continue
+		}
+		p.checkWhitespace(p.text)
+		line := stripComment(strings.TrimSpace(p.stripBlockComments(p.text)), p.cfg.Comment)
+
+		if line != "" {
+			p.parseLine(line)
+		}
+	}
+
+	if m := p.defining; m != nil {
+		p.errs = append(p.errs, AssemblyError{File: m.file, Line: m.line, Source: m.text, Err: fmt.Errorf("macro %s is never closed with .endm", m.name)})
+		p.defining = nil
+	}
+	p.closeConditionals(depth)
+	if p.commentLine != 0 {
+		p.errs = append(p.errs, AssemblyError{File: p.file, Line: p.commentLine, Source: p.commentText, Err: errors.New("block comment is never closed with */")})
+		p.commentLine = 0
+	}
+
+	if err := scanner.Err(); err != nil {
+		// Reading stops at the line that failed, which is the one after the
+		// last line read
+		p.line++
+		p.text = ""
+		if errors.Is(err, bufio.ErrTooLong) {
+			p.errorf("line too long (more than %d bytes)", maxLineLength)
+		} else {
+			p.errorf("reading source: %w", err)
+		}
+	}
+}
+
+// parseLine handles a single line with the comment removed.
+func (p *parser) parseLine(line string) {
+	if p.defining != nil {
+		p.recordMacroLine(line)
+		return
+	}
+	if p.parseConditional(line) {
+		return
+	}
+
+	switch {
+	case isDirective(line):
+		if err := p.parseDirective(line); err != nil {
+			p.errorf("%w", err)
+		}
+	case p.cfg.isTag(line):
+		// A tag can be followed by the instruction it labels, as in
+		// #loop: ADD R0 1, where the colon is optional
+		tagName, rest := splitTag(line[len(p.cfg.LabelPrefix):])
+		if existing, ok := p.syms.tags[tagName]; ok {
+			p.errorf("tag %s is already defined on %s", tagName, existing.Location())
+		} else {
+			p.syms.tags[tagName] = &Tag{Address: p.address, Line: p.line, File: p.file}
+		}
+		if rest != "" {
+			p.parseLine(rest)
+		}
+	default:
+		// A line of nothing but commas has no fields at all
+		if fields := splitOperands(line); len(fields) > 0 && p.macros[fields[0]] != nil {
+			p.addDirective(line)
+			p.expandMacro(p.macros[fields[0]], fields[1:])
+			return
+		}
+		p.addInstruction(line)
+	}
+}
+
+// splitTag splits the text after a label prefix into the tag name, which
+// runs to the first colon or whitespace, and the rest of the line after the
+// colon.
+func splitTag(text string) (name, rest string) {
+	end := strings.IndexFunc(text, func(r rune) bool {
+		return r == ':' || unicode.IsSpace(r)
+	})
+	if end < 0 {
+		return text, ""
+	}
+	rest = strings.TrimSpace(text[end:])
+	rest = strings.TrimSpace(strings.TrimPrefix(rest, ":"))
+	return text[:end], rest
+}
+
+// include reads another source file in place of the directive. The path is
+// relative to the directory of the file containing the directive.
+func (p *parser) include(name string) error {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(p.including, abs) {
+		return fmt.Errorf("include cycle: %s is already being included", name)
+	}
+
+	// Recorded even when the file can't be opened, so watch mode picks
+	// it up once it is created
+	p.files = append(p.files, path)
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	outerLine, outerText, outerFile, outerDir := p.line, p.text, p.file, p.dir
+	p.line, p.file, p.dir = 0, path, filepath.Dir(path)
+	p.including = append(p.including, abs)
+
+	p.parseSource(file)
+
+	p.line, p.text, p.file, p.dir = outerLine, outerText, outerFile, outerDir
+	p.including = p.including[:len(p.including)-1]
+	return nil
+}
+
+// errorf records a problem with the current source line.
+func (p *parser) errorf(format string, args ...any) {
+	p.errs = append(p.errs, AssemblyError{File: p.file, Line: p.line, Source: p.text, Err: fmt.Errorf(format, args...)})
+}
+
+func (p *parser) strictf(format string, args ...any) {
+	p.strict = append(p.strict, fmt.Sprintf(format, args...))
+}
+
+// checkWhitespace notes whitespace other than spaces and tabs, such as
+// non-breaking spaces pasted from a document.
+func (p *parser) checkWhitespace(line string) {
+	for _, r := range line {
+		if unicode.IsSpace(r) && r != ' ' && r != '\t' {
+			p.strictf("%s: unusual whitespace character %U", p.location(), r)
+			return
+		}
+	}
+}
+
+// location describes the current source line for error messages.
+func (p *parser) location() string {
+	return location(p.file, p.line)
+}
+
+// addInstruction places a line that assembles to a word at the current
+// address.
+func (p *parser) addInstruction(text string) {
+	if existing, ok := p.used[p.address]; ok {
+		p.errorf("address %d is already used by %s", p.address, existing)
+	}
+	p.used[p.address] = p.location()
+	p.instructions = append(p.instructions, Instruction{Text: text, Line: p.line, File: p.file, Address: p.address})
+	p.address++
+}
+
+// addDirective notes a line that doesn't place a word, such as .org or a use
+// of a macro, at the current address.
+func (p *parser) addDirective(text string) {
+	p.directives = append(p.directives, Instruction{Text: text, Line: p.line, File: p.file, Address: p.address})
+}
+
+// parseDirective handles a line starting with a dot.
+func (p *parser) parseDirective(line string) error {
+	fields := strings.Fields(line)
+	switch fields[0] {
+	case ".org":
+		if len(fields) != 2 {
+			return fmt.Errorf(".org takes a single address: %s", line)
+		}
+		org, err := parseInteger(fields[1])
+		if err != nil || org < 0 {
+			return fmt.Errorf("invalid .org address: %s", fields[1])
+		}
+		if org > maxAddress {
+			return fmt.Errorf(".org address is past the highest address %d: %s", maxAddress, fields[1])
+		}
+		p.address = int(org)
+		p.addDirective(line)
+	case ".align":
+		if len(fields) != 2 {
+			return fmt.Errorf(".align takes a single boundary: %s", line)
+		}
+		boundary, err := parseInteger(fields[1])
+		if err != nil || boundary <= 0 || boundary&(boundary-1) != 0 {
+			return fmt.Errorf(".align boundary should be a power of two: %s", fields[1])
+		}
+		if boundary > maxAddress {
+			return fmt.Errorf(".align boundary is past the highest address %d: %s", maxAddress, fields[1])
+		}
+		// Skipped words are filled like any other gap
+		p.address = (p.address + int(boundary) - 1) &^ (int(boundary) - 1)
+		p.addDirective(line)
+	case ".word", ".byte":
+		// Each value becomes its own data word so it gets its own address,
+		// keeping the line it is on as its source
+		values, err := splitValues(strings.TrimSpace(line[len(fields[0]):]))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fields[0], err)
+		}
+		offset := len(fields[0])
+		for _, value := range values {
+			offset += strings.Index(line[offset:], value)
+			p.addInstruction(line)
+			data := &p.instructions[len(p.instructions)-1]
+			data.value, data.column = value, utf8.RuneCountInString(line[:offset])+1
+			offset += len(value)
+		}
+	case ".bits":
+		if len(fields) != 2 {
+			return fmt.Errorf(".bits takes a single bit string: %s", line)
+		}
+		p.addInstruction(line)
+	case ".macro":
+		p.addDirective(line)
+		return p.defineMacro(fields)
+	case ".endm":
+		return errors.New(".endm without .macro")
+	case ".include":
+		name, err := strconv.Unquote(strings.TrimSpace(line[len(fields[0]):]))
+		if err != nil {
+			return fmt.Errorf(".include takes a quoted file name: %s", line)
+		}
+		p.addDirective(line)
+		return p.include(name)
+	case ".equ":
+		if len(fields) < 3 {
+			return fmt.Errorf(".equ takes a name and a value: %s", line)
+		}
+		// The value is the rest of the line, as a character literal can
+		// hold a space
+		rest := strings.TrimSpace(line[len(fields[0]):])
+		p.addDirective(line)
+		return p.defineConstant(fields[1], strings.TrimSpace(rest[len(fields[1]):]))
+	default:
+		return fmt.Errorf("unknown directive: %s", fields[0])
+	}
+	return nil
+}
+
+func (p *parser) defineConstant(name, value string) error {
+	if !isIdentifier(name) {
+		return fmt.Errorf("invalid constant name: %s", name)
+	}
+	if existing, ok := p.syms.constants[name]; ok {
+		return fmt.Errorf("constant %s is already defined on %s", name, existing.location)
+	}
+
+	// Resolve constants defined in terms of other constants straight away,
+	// which also rules out cycles
+	if isIdentifier(value) {
+		other, ok := p.syms.constants[value]
+		if !ok {
+			return fmt.Errorf("undefined constant: %s", value)
+		}
+		value = other.value
+	}
+
+	p.syms.constants[name] = &constant{value: value, location: p.location()}
+	return nil
+}
+
+// splitValues splits a comma separated list of values, leaving commas inside
+// quotes alone.
+func splitValues(list string) ([]string, error) {
+	var values []string
+	var quote byte
+	start := 0
+	for i := 0; i <= len(list); i++ {
+		if i < len(list) {
+			switch c := list[i]; {
+			case c == '\\':
+				i++
+				continue
+			case quote != 0:
+				if c == quote {
+					quote = 0
+				}
+				continue
+			case c == '\'' || c == '"':
+				quote = c
+				continue
+			case c != ',':
+				continue
+			}
+		}
+		value := strings.TrimSpace(list[start:i])
+		// Values are separated by commas, so anything else splitting a value
+		// in two is a mistake
+		if value == "" || len(strings.Fields(value)) > 1 && !strings.HasPrefix(value, "'") {
+			return nil, fmt.Errorf("invalid value list: %s", list)
+		}
+		values = append(values, value)
+		start = i + 1
+	}
+	return values, nil
+}
+
+// splitOperands splits an instruction into its mnemonic and operands, which
+// can be separated by whitespace, commas or both. Separators inside a quoted
+// literal such as ',' or inside parentheses are kept.
+func splitOperands(instruction string) []string {
+	parts, _ := splitOperandList(instruction)
+	return parts
+}
+
+// splitOperandList is splitOperands, but also returns the index of the first
+// operand left empty by a stray comma, as in ADD R0, or ADD R0,,5, or -1 if
+// there isn't one.
+func splitOperandList(instruction string) (parts []string, empty int) {
+	empty = -1
+	var field strings.Builder
+	var quote rune
+	escaped := false
+	depth := 0     // Parentheses left open
+	comma := false // Whether a comma has been seen since the last operand
+	for i, r := range instruction {
+		// Copied from the instruction rather than written as a rune, so
+		// every part is a substring of the instruction even when it isn't
+		// valid UTF-8
+		char := instruction[i : i+runeSize(instruction[i:])]
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case depth <= 0 && (r == ',' || unicode.IsSpace(r)):
+			if field.Len() > 0 {
+				parts = append(parts, field.String())
+				field.Reset()
+			} else if r == ',' && (comma || len(parts) == 0) && empty < 0 {
+				empty = len(parts)
+			}
+			if r == ',' {
+				comma = true
+			}
+			continue
+		}
+		field.WriteString(char)
+		comma = false
+	}
+	if field.Len() > 0 {
+		parts = append(parts, field.String())
+	} else if comma && empty < 0 {
+		empty = len(parts)
+	}
+	return parts, empty
+}
+
+// byteOrderMark is written at the start of files by some editors on Windows.
+const byteOrderMark = "\uFEFF"
+
+// stripBOM removes the byte order mark from the first line of a file, where
+// it would otherwise stick to the first mnemonic.
+func stripBOM(line string) string {
+	return strings.TrimPrefix(line, byteOrderMark)
+}
+
+// runeSize is the number of bytes taken by the rune s starts with, which is
+// 1 for a byte that isn't valid UTF-8.
+func runeSize(s string) int {
+	_, size := utf8.DecodeRuneInString(s)
+	return size
+}
+
+// stripComment removes a comment starting with prefix and running to the end
+// of the line, along with any whitespace before it. Comment markers inside
+// quoted literals or escaped with a backslash are kept.
+func stripComment(line, prefix string) string {
+	if i := commentIndex(line, prefix); i >= 0 {
+		return strings.TrimSpace(line[:i])
+	}
+	return line
+}
+
+// commentIndex returns where the comment starting with prefix begins in line,
+// or -1 if there is none.
+func commentIndex(line, prefix string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\\':
+			i++ // Skip the escaped character
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(line[i:], prefix):
+			return i
+		}
+	}
+	return -1
+}
+
+// stripBlockComments replaces every /* */ comment in line with a space,
+// keeping track of a comment that is still open at the end of the line so it
+// carries on over the lines after it. Markers inside quoted literals or after
+// a line comment are kept.
+func (p *parser) stripBlockComments(line string) string {
+	var stripped strings.Builder
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case p.commentLine != 0:
+			if strings.HasPrefix(line[i:], "*/") {
+				p.commentLine = 0
+				stripped.WriteByte(' ')
+				i++
+			}
+			continue
+		case c == '\\':
+			stripped.WriteByte(c)
+			if i+1 < len(line) {
+				i++
+				c = line[i]
+			}
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case strings.HasPrefix(line[i:], p.cfg.Comment):
+			// The rest of the line is a line comment
+			return stripped.String() + line[i:]
+		case strings.HasPrefix(line[i:], "/*"):
+			p.commentLine, p.commentText = p.line, p.text
+			i++
+			continue
+		}
+		stripped.WriteByte(c)
+	}
+	return stripped.String()
+}
+
+func isDirective(line string) bool {
+	return strings.HasPrefix(line, ".")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+const defaultConfigPath = "config.json"
+
+// configEnv names the environment variable holding the config path used when
+// -c isn't given.
+const configEnv = "LASM_CONFIG"
+
+// defaultConfigJSON is the built-in opcode table used when no config file is
+// found.
+//
+//go:embed config.json
+var defaultConfigJSON []byte
+
+// resolveConfigPath picks the config file to load. An explicit -c flag always
+// wins, then the LASM_CONFIG environment variable, otherwise config.json in
+// the working directory is used, falling back to a config.json next to the
+// source file. An empty path means no config file was found and the embedded
+// defaults should be used.
+func resolveConfigPath(filename string) string {
+	if *configPath != "" {
+		return *configPath
+	}
+	if path := os.Getenv(configEnv); path != "" {
+		return path
+	}
+	candidates := []string{defaultConfigPath}
+	if filename != "" {
+		candidates = append(candidates, filepath.Join(filepath.Dir(filename), defaultConfigPath))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// defaultConfig decodes the embedded config. A config file replaces it
+// entirely rather than merging with it.
+func defaultConfig() (assembler.Config, error) {
+	config, err := decodeConfig(defaultConfigJSON)
+	if err != nil {
+		return config, fmt.Errorf("embedded config: %w", err)
+	}
+	return config, nil
+}
+
+func loadConfig(path string) (assembler.Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return assembler.Config{}, err
+	}
+	config, err := decodeConfig(data)
+	if err != nil {
+		return config, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// architectures is a config holding several named configs, one of which is
+// picked with -arch or else by default_architecture.
+type architectures struct {
+	Architectures map[string]json.RawMessage `json:"architectures"`
+	Default       string                     `json:"default_architecture"`
+}
+
+// decodeConfig decodes a config, picking the architecture asked for when it
+// holds several.
+func decodeConfig(data []byte) (assembler.Config, error) {
+	var config assembler.Config
+	var archs architectures
+	if err := json.Unmarshal(data, &archs); err != nil {
+		return config, err
+	}
+	if archs.Architectures == nil {
+		if *arch != "" {
+			return config, fmt.Errorf("architecture %s is asked for but the config doesn't define any architectures", *arch)
+		}
+		err := json.Unmarshal(data, &config)
+		return config, err
+	}
+
+	names := make([]string, 0, len(archs.Architectures))
+	for name := range archs.Architectures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	name := *arch
+	if name == "" {
+		name = archs.Default
+	}
+	if name == "" {
+		return config, fmt.Errorf("no architecture chosen, use -arch or set default_architecture to one of: %s", strings.Join(names, ", "))
+	}
+	raw, ok := archs.Architectures[name]
+	if !ok {
+		return config, fmt.Errorf("unknown architecture %s, expected one of: %s", name, strings.Join(names, ", "))
+	}
+	if err := json.Unmarshal(raw, &config); err != nil {
+		return config, fmt.Errorf("architecture %s: %w", name, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// disassembleFile reads a file of hex words, one per line as written by the
+// logisim format, and prints the instructions they encode. Trailing zero
+// words are taken to be padding and skipped, and words printed as .word get a
+// comment with their raw fields.
+func disassembleFile(path string, cfg assembler.Config) error {
+	words, err := readHexWords(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := cfg.OpcodeNames(); err != nil {
+		return err
+	}
+
+	for len(words) > 0 && words[len(words)-1] == 0 {
+		words = words[:len(words)-1]
+	}
+
+	for i, word := range words {
+		line, err := cfg.DisassembleWord(word)
+		if err != nil {
+			return fmt.Errorf("%s: address %d: %w", path, i, err)
+		}
+		if strings.HasPrefix(line, ".word") {
+			line += " " + rawComment(word, cfg)
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// rawComment describes the opcode, destination and data bits of a word that
+// doesn't decode to an instruction, naming the opcode when it is known.
+func rawComment(word uint64, cfg assembler.Config) string {
+	bits := fmt.Sprintf("%0*b", cfg.WordWidth, word)
+	opcodeWidth := cfg.WordWidth - cfg.DestWidth - cfg.DataWidth
+	opcode := bits[:opcodeWidth]
+	raw := fmt.Sprintf("%s %s %s", opcode, bits[opcodeWidth:opcodeWidth+cfg.DestWidth], bits[opcodeWidth+cfg.DestWidth:])
+
+	names, _ := cfg.OpcodeNames()
+	if name, ok := names[opcode]; ok {
+		return fmt.Sprintf("%s %s with operands it doesn't take: %s", cfg.Comment, name, raw)
+	}
+	return fmt.Sprintf("%s unknown opcode %s: %s", cfg.Comment, opcode, raw)
+}
+
+// maxHexWords is the most words readHexWords reads, which keeps a huge run
+// length from using up memory.
+const maxHexWords = 1 << 24
+
+func readHexWords(path string) ([]uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+	defer file.Close()
+
+	var words []uint64
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		// Drop comments written by -annotate and -addr-comments
+		line, _, _ := strings.Cut(strings.TrimPrefix(scanner.Text(), "\uFEFF"), "//")
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSuffix(strings.TrimSpace(line), ";")
+		if line == "" || line == logisimImageHeader {
+			continue
+		}
+		// Runs written by -rle look like count*word
+		count := uint64(1)
+		if before, after, ok := strings.Cut(line, "*"); ok {
+			count, err = strconv.ParseUint(before, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid run length: %s", path, lineNum, line)
+			}
+			line = after
+		}
+		word, err := strconv.ParseUint(line, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hex word: %s", path, lineNum, line)
+		}
+		if count > maxHexWords-uint64(len(words)) {
+			return nil, fmt.Errorf("%s:%d: more than %d words", path, lineNum, maxHexWords)
+		}
+		for i := uint64(0); i < count; i++ {
+			words = append(words, word)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return words, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// formatFiles rewrites each file in the canonical layout, leaving files that
+// are already formatted untouched. Stdin is formatted to stdout when no files
+// are given.
+func formatFiles(filenames []string) error {
+	if len(filenames) == 0 {
+		cfg, err := setUpConfig("")
+		if err != nil {
+			return err
+		}
+		formatted, err := assembler.Format(os.Stdin, cfg)
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.WriteString(formatted)
+		return err
+	}
+
+	for _, name := range filenames {
+		if !strings.HasSuffix(name, ".asm") {
+			return fmt.Errorf("file must have .asm extension: %s", name)
+		}
+		cfg, err := setUpConfig(name)
+		if err != nil {
+			return err
+		}
+		source, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		formatted, err := assembler.Format(strings.NewReader(string(source)), cfg)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if formatted == string(source) {
+			continue
+		}
+		if err := os.WriteFile(name, []byte(formatted), 0644); err != nil {
+			return fmt.Errorf("writing %s: %w", name, err)
+		}
+		if !*quiet {
+			fmt.Fprintf(os.Stderr, "Formatted %s\n", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// formatGoSlice renders memory as Go source declaring an array holding every
+// word, named with -go-var in the package named with -go-package. Each
+// assembled word is preceded by a comment holding its source.
+func formatGoSlice(program assembler.Program, cfg assembler.Config) (string, error) {
+	if !token.IsIdentifier(*goVar) {
+		return "", fmt.Errorf("invalid Go variable name: %q", *goVar)
+	}
+	if !token.IsIdentifier(*goPackage) {
+		return "", fmt.Errorf("invalid Go package name: %q", *goPackage)
+	}
+
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+	sources := make(map[int]string)
+	for _, word := range program.Words {
+		sources[word.Source.Address] = word.Source.Text
+	}
+
+	var src strings.Builder
+	src.WriteString("// Code generated by lasm. DO NOT EDIT.\n\n")
+	src.WriteString(fmt.Sprintf("package %s\n\n", *goPackage))
+	src.WriteString(fmt.Sprintf("var %s = [%d]%s{\n", *goVar, len(words), goWordType(cfg)))
+	for address, word := range words {
+		if source, ok := sources[address]; ok {
+			src.WriteString(fmt.Sprintf("\t// %s\n", source))
+		}
+		src.WriteString(fmt.Sprintf("\t0x%0*X,\n", wordHexDigits(cfg), word))
+	}
+	src.WriteString("}\n")
+
+	return src.String(), nil
+}
+
+// goWordType is the smallest unsigned Go integer type a whole word fits in.
+func goWordType(cfg assembler.Config) string {
+	for _, bits := range []int{8, 16, 32} {
+		if cfg.WordWidth <= bits {
+			return fmt.Sprintf("uint%d", bits)
+		}
+	}
+	return "uint64"
+}
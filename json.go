@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// jsonOutput is the document written by the json format. Field order and
+// names are kept stable for tools reading it.
+type jsonOutput struct {
+	Words  []jsonWord  `json:"words"`
+	Tags   []jsonTag   `json:"tags"`
+	Errors []jsonError `json:"errors"`
+}
+
+type jsonWord struct {
+	Address  int      `json:"address"`
+	Mnemonic string   `json:"mnemonic"`
+	Operands []string `json:"operands"`
+	Opcode   string   `json:"opcode"`
+	Dest     string   `json:"dest"`
+	Data     string   `json:"data"`
+	Hex      string   `json:"hex"`
+	Binary   string   `json:"binary"`
+	Source   string   `json:"source"`
+	File     string   `json:"file,omitempty"`
+	Line     int      `json:"line"`
+}
+
+type jsonTag struct {
+	Name       string `json:"name"`
+	Address    int    `json:"address"`
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line"`
+	Referenced bool   `json:"referenced"`
+}
+
+type jsonError struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line"`
+	Source  string `json:"source"`
+	Column  int    `json:"column,omitempty"`
+	Message string `json:"message"`
+}
+
+// formatJSON renders every assembled word with its encoded fields and source,
+// sorted by address, along with the tags sorted by address and name.
+func formatJSON(program assembler.Program, cfg assembler.Config) (string, error) {
+	output := jsonOutput{Words: []jsonWord{}, Tags: []jsonTag{}, Errors: []jsonError{}}
+
+	for _, word := range program.Words {
+		hex, err := wordToHex(word, cfg)
+		if err != nil {
+			return "", err
+		}
+		fields := word.Source.Fields()
+		mnemonic := fields[0]
+		if word.Opcode != "" {
+			names, _ := cfg.OpcodeNames()
+			mnemonic = names[word.Opcode]
+		}
+		output.Words = append(output.Words, jsonWord{
+			Address:  word.Source.Address,
+			Mnemonic: mnemonic,
+			Operands: append([]string{}, fields[1:]...),
+			Opcode:   word.Opcode,
+			Dest:     word.Dest,
+			Data:     word.Data,
+			Hex:      hex,
+			Binary:   word.Bits(),
+			Source:   word.Source.Text,
+			File:     word.Source.File,
+			Line:     word.Source.Line,
+		})
+	}
+	sort.SliceStable(output.Words, func(i, j int) bool {
+		return output.Words[i].Address < output.Words[j].Address
+	})
+
+	output.Tags = jsonTags(program)
+
+	return marshalJSON(output)
+}
+
+// jsonTags lists the tags of a program sorted by address and name.
+func jsonTags(program assembler.Program) []jsonTag {
+	tags := []jsonTag{}
+	for name, tag := range program.Tags {
+		tags = append(tags, jsonTag{
+			Name:       name,
+			Address:    tag.Address,
+			File:       tag.File,
+			Line:       tag.Line,
+			Referenced: tag.Referenced,
+		})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		a, b := tags[i], tags[j]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		return a.Name < b.Name
+	})
+	return tags
+}
+
+// sourceMap is the document written by the sourcemap format, which maps
+// addresses back to source lines for simulators and debuggers.
+type sourceMap struct {
+	Addresses []sourceMapEntry `json:"addresses"`
+	Tags      []jsonTag        `json:"tags"`
+}
+
+type sourceMapEntry struct {
+	Address int      `json:"address"`
+	Word    bool     `json:"word"` // Whether a word is placed at the address
+	Kind    string   `json:"kind"` // One of instruction, data, directive or macro
+	File    string   `json:"file,omitempty"`
+	Line    int      `json:"line"`
+	Source  string   `json:"source"`
+	Tags    []string `json:"tags"` // Tags defined at the address of a word
+}
+
+// formatSourceMap renders the file, line and text each assembled word comes
+// from, sorted by address, with the tags defined at each address. Lines that
+// don't place a word, such as .org, .equ or a use of a macro, are listed at
+// the address they apply at, ahead of the word there.
+func formatSourceMap(program assembler.Program, cfg assembler.Config) (string, error) {
+	tags := jsonTags(program)
+	output := sourceMap{Addresses: []sourceMapEntry{}, Tags: tags}
+	for _, directive := range program.Directives {
+		kind := "directive"
+		if !strings.HasPrefix(directive.Text, ".") {
+			kind = "macro"
+		}
+		output.Addresses = append(output.Addresses, sourceMapEntry{
+			Address: directive.Address,
+			Kind:    kind,
+			File:    directive.File,
+			Line:    directive.Line,
+			Source:  directive.Text,
+			Tags:    []string{},
+		})
+	}
+	for _, word := range program.Words {
+		entry := sourceMapEntry{
+			Address: word.Source.Address,
+			Word:    true,
+			Kind:    "instruction",
+			File:    word.Source.File,
+			Line:    word.Source.Line,
+			Source:  word.Source.Text,
+			Tags:    []string{},
+		}
+		if word.Opcode == "" {
+			entry.Kind = "data"
+		}
+		for _, tag := range tags {
+			if tag.Address == entry.Address {
+				entry.Tags = append(entry.Tags, tag.Name)
+			}
+		}
+		output.Addresses = append(output.Addresses, entry)
+	}
+	sort.SliceStable(output.Addresses, func(i, j int) bool {
+		a, b := output.Addresses[i], output.Addresses[j]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		return !a.Word && b.Word
+	})
+
+	return marshalJSON(output)
+}
+
+// formatJSONErrors renders the json format for a program that failed to
+// assemble, which only has errors.
+func formatJSONErrors(errs assembler.AssemblyErrors) (string, error) {
+	output := jsonOutput{Words: []jsonWord{}, Tags: []jsonTag{}, Errors: []jsonError{}}
+	for _, err := range errs {
+		output.Errors = append(output.Errors, jsonError{
+			File:    err.File,
+			Line:    err.Line,
+			Source:  err.Source,
+			Column:  err.Column,
+			Message: err.Err.Error(),
+		})
+	}
+	return marshalJSON(output)
+}
+
+func marshalJSON(output any) (string, error) {
+	data, err := json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding json: %w", err)
+	}
+	return string(data) + "\n", nil
+}
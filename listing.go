@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// formatListing renders the assembled program as a listing with one line per
+// instruction showing its address, machine word, encoded fields and source.
+// Tags are written as labels in front of the instruction they point to.
+func formatListing(program assembler.Program, cfg assembler.Config) (string, error) {
+	labels := make(map[int][]string)
+	var labelAddresses []int
+	for name, tag := range program.Tags {
+		if labels[tag.Address] == nil {
+			labelAddresses = append(labelAddresses, tag.Address)
+		}
+		labels[tag.Address] = append(labels[tag.Address], name)
+	}
+	sort.Ints(labelAddresses)
+
+	var listing strings.Builder
+	// writeLabels writes the labels of every address up to and including
+	// the given one that haven't been written yet
+	writeLabels := func(address int) {
+		for len(labelAddresses) > 0 && labelAddresses[0] <= address {
+			names := labels[labelAddresses[0]]
+			sort.Strings(names)
+			for _, name := range names {
+				listing.WriteString(fmt.Sprintf("%-28s%s%s (%s)\n", "", cfg.LabelPrefix, name, formatAddress(labelAddresses[0], 2)))
+			}
+			labelAddresses = labelAddresses[1:]
+		}
+	}
+
+	words := slices.Clone(program.Words)
+	sort.SliceStable(words, func(i, j int) bool {
+		return words[i].Source.Address < words[j].Source.Address
+	})
+
+	// The word column fits the header even when words are narrower
+	wordColumn := max(len("WORD"), wordHexDigits(cfg))
+	listing.WriteString(fmt.Sprintf("%-4s %-*s  %-15s  %s\n", "ADDR", wordColumn, "WORD", "OPCODE DEST DATA", "SOURCE"))
+	for _, word := range words {
+		address := word.Source.Address
+		writeLabels(address)
+		fields := word.Data
+		if word.Opcode != "" {
+			fields = fmt.Sprintf("%s %s %s", word.Opcode, word.Dest, word.Data)
+		}
+		hex, err := wordToHex(word, cfg)
+		if err != nil {
+			return "", err
+		}
+		listing.WriteString(fmt.Sprintf("%-4s %-*s  %-15s  %s\n", formatAddress(address, 2), wordColumn, hex, fields, word.Source.Text))
+	}
+
+	// Write any tags pointing past the last instruction
+	writeLabels(math.MaxInt)
+
+	return listing.String(), nil
+}
+
+// formatTagMap renders every tag with its address in decimal and in the radix
+// chosen with -addr-radix, sorted by address, and whether it was referenced by
+// any instruction.
+func formatTagMap(tags map[string]*assembler.Tag) string {
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := tags[names[i]], tags[names[j]]
+		if a.Address != b.Address {
+			return a.Address < b.Address
+		}
+		return names[i] < names[j]
+	})
+
+	var tagMap strings.Builder
+	// Decimal addresses are only written once
+	radix := ""
+	if *addrRadix != "dec" {
+		radix = fmt.Sprintf("%-4s ", strings.ToUpper(*addrRadix))
+	}
+	tagMap.WriteString(fmt.Sprintf("%-4s %s%-10s %s\n", "DEC", radix, "REFERENCED", "TAG"))
+	for _, name := range names {
+		tag := tags[name]
+		referenced := "no"
+		if tag.Referenced {
+			referenced = "yes"
+		}
+		address := ""
+		if *addrRadix != "dec" {
+			address = fmt.Sprintf("%-4s ", formatAddress(tag.Address, 2))
+		}
+		tagMap.WriteString(fmt.Sprintf("%-4d %s%-10s %s\n", tag.Address, address, referenced, name))
+	}
+
+	return tagMap.String()
+}
+
+// formatAddress writes an address in the radix chosen with -addr-radix, with
+// at least the given number of digits.
+func formatAddress(address, digits int) string {
+	switch *addrRadix {
+	case "oct":
+		return fmt.Sprintf("%0*o", digits, address)
+	case "dec":
+		return fmt.Sprintf("%0*d", digits, address)
+	default:
+		return fmt.Sprintf("%0*X", digits, address)
+	}
+}
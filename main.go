@@ -1,276 +1,439 @@
 package main
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"os"
-	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/boenkyo/lasm/assembler"
 )
 
 var (
-	cfg      config
-	hadError bool
+	configPath    = flag.String("c", "", "path to the config file (default: $LASM_CONFIG, or \"config.json\")")
+	arch          = flag.String("arch", "", "architecture to use from a config defining several (default: default_architecture from config)")
+	outputPath    = flag.String("o", "", "path to the output file (default: input file with the extension of the output format)")
+	extension     = flag.String("ext", "", "extension of the output file (default: depends on the output format, .hex for logisim)")
+	stdinName     = flag.String("name", "", "base name of the output file when reading from stdin, e.g. foo for foo.hex")
+	listingPath   = flag.String("l", "", "path to write a listing file to")
+	mapPath       = flag.String("map", "", "path to write the tag table to")
+	warnError     = flag.Bool("Werror", false, "treat warnings as errors")
+	strict        = flag.Bool("strict", false, "fail on everything that is otherwise tolerated, including warnings")
+	format        = flag.String("format", "logisim", "output format: "+strings.Join(formatNames(), ", "))
+	endian        = flag.String("endian", "big", "byte order of words in byte based formats: big or little")
+	logisimHeader = flag.Bool("logisim", false, "start logisim and raw output with the \"v2.0 raw\" header needed by Logisim itself")
+	rle           = flag.Bool("rle", false, "write runs of the same word as count*word in the logisim and raw formats")
+	addrRadix     = flag.String("addr-radix", "hex", "radix of addresses in the listing, tag map and pretty format: oct, dec or hex")
+	addrComments  = flag.Int("addr-comments", 0, "write a # addr comment line before every N words in the logisim and raw formats")
+	annotate      = flag.Bool("annotate", false, "comment each word with its address and source in the logisim, raw and readmemh formats")
+	goVar         = flag.String("go-var", "rom", "name of the variable declared by the goslice format")
+	goPackage     = flag.String("go-package", "main", "package of the file written by the goslice format")
+	crlf          = flag.Bool("crlf", false, "end lines of text output with CRLF instead of LF")
+	trimNewline   = flag.Bool("no-final-newline", false, "leave out the newline after the last line of text output")
+	sparse        = flag.Bool("sparse", false, "skip unassembled addresses using @address markers in the readmemh format")
+	disassemble   = flag.String("d", "", "disassemble the given hex file instead of assembling")
+	fill          = flag.String("fill", "", "word to fill unused memory with, as a number like 0x0200 or an instruction like RET (default 0)")
+	memorySize    = flag.Int("size", 0, "number of words to pad the output to (default: memory_size from config, or 64)")
+	pad           = flag.Int("pad", 0, "number of fill words to write after the program instead of padding to the memory size, ignored with -size")
+	noPad         = flag.Bool("no-pad", false, "write only the assembled words, without padding them to the memory size")
+	stats         = flag.Bool("stats", false, "print how often each opcode is used")
+	check         = flag.Bool("check", false, "assemble without writing any files")
+	defines       stringList
+	inline        stringList
+	showVersion   = flag.Bool("version", false, "print the version and exit")
+	watchFiles    = flag.Bool("watch", false, "assemble again whenever an input file or the config changes")
+	formatSource  = flag.Bool("fmt", false, "rewrite the given files in the canonical layout instead of assembling, or format stdin to stdout")
+	verify        = flag.Bool("verify", false, "compare the output against the expected output given as the last file, without writing any files")
+	maxErrors     = flag.Int("max-errors", 20, "stop after this many errors, 0 for no limit")
+	quiet         = flag.Bool("quiet", false, "leave out the assembly trace and summary, printing only errors, warnings and the output")
 )
 
-type config struct {
-	Opcodes map[string]string `json:"opcodes"`
-}
-
 func main() {
-	var (
-		useFile  bool
-		filename string
-		reader   io.Reader
-	)
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+}
 
-	cfg = loadConfig()
+func run() error {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: lasm [-c config] [-o output] <file>...")
+		fmt.Fprintln(os.Stderr, "       lasm [-c config] -d <hex file>")
+		flag.PrintDefaults()
+	}
+	flag.BoolVar(showVersion, "v", false, "shorthand for -version")
+	flag.BoolVar(check, "n", false, "shorthand for -check")
+	flag.BoolVar(quiet, "q", false, "shorthand for -quiet")
+	flag.Var(&defines, "D", "define a symbol for .if blocks, can be given more than once")
+	flag.Var(&inline, "e", "assemble the given instructions, separated by semicolons or newlines, instead of a file; can be given more than once")
+	flag.Parse()
+
+	if *showVersion {
+		printVersion()
+		return nil
+	}
 
-	switch len(os.Args) {
-	case 1:
-		useFile = false
-		reader = os.Stdin
-	case 2:
-		useFile = true
-	default:
-		fmt.Println("Usage: lasm <file>")
-		return
+	if *formatSource {
+		return formatFiles(flag.Args())
 	}
 
-	if useFile {
-		filename = os.Args[1]
-		if !strings.HasSuffix(filename, ".asm") {
-			fmt.Println("File must have .asm extension")
-			return
+	if *watchFiles {
+		if flag.NArg() == 0 || *disassemble != "" {
+			return errors.New("-watch needs an input file to assemble")
 		}
-		file, err := os.Open(filename)
-		if err != nil {
-			fmt.Printf("Error opening file: %s\n", err)
-			return
-		}
-		defer file.Close()
-		reader = file
+		watch(flag.Args()) // Runs until interrupted
 	}
 
-	instructions, tags := parse(reader)
-	program := assembleProgram(instructions, tags)
-
-	if hadError {
-		return
-	}
+	return build(flag.Args())
+}
 
-	hex := convertToHexAndFormat(program)
-	if useFile {
-		hexFilename := strings.TrimSuffix(filename, ".asm") + ".hex"
-		if err := os.WriteFile(hexFilename, []byte(hex), 0644); err != nil {
-			fmt.Printf("Error writing to file: %s\n", err)
-			return
+// build assembles the given files, or stdin when there are none or the only
+// one is -, and writes the output. With -verify the last file holds the
+// expected output instead. It runs once for every pass in watch mode,
+// so everything it depends on is loaded again each time.
+func build(filenames []string) error {
+	var expectedPath string
+	if *verify {
+		if len(filenames) == 0 {
+			return errors.New("-verify needs the file holding the expected output after the input files")
 		}
-		fmt.Printf("%d instructions assembled and written to %s.\n\n", len(program), hexFilename)
-	} else {
-		fmt.Printf("%d instructions assembled:\n\n", len(program))
-		fmt.Println("-----")
-		fmt.Println(hex)
-		fmt.Println("-----")
+		expectedPath = filenames[len(filenames)-1]
+		filenames = filenames[:len(filenames)-1]
+	}
+	if len(filenames) == 1 && filenames[0] == "-" {
+		filenames = nil
+	}
+	if len(inline) > 0 && len(filenames) > 0 {
+		return errors.New("-e can't be combined with input files")
+	}
+	var filename string // First input file, empty when reading stdin
+	if len(filenames) > 0 {
+		filename = filenames[0]
 	}
-}
 
-func loadConfig() config {
-	var config config
-	file, err := os.Open("config.json")
+	configFilename := filename
+	if *disassemble != "" {
+		configFilename = *disassemble
+	}
+	cfg, err := setUpConfig(configFilename)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer file.Close()
 
-	if err := json.NewDecoder(file).Decode(&config); err != nil {
-		panic(err)
+	if *disassemble != "" {
+		return disassembleFile(*disassemble, cfg)
 	}
 
-	return config
-}
-
-func convertToHexAndFormat(program []string) string {
-	var hex strings.Builder
-	for _, instr := range program {
-		binary, err := strconv.ParseInt(instr, 2, 64)
-		if err != nil {
-			panic(err)
+	for _, name := range filenames {
+		if !strings.HasSuffix(name, ".asm") {
+			return fmt.Errorf("file must have .asm extension: %s", name)
 		}
-		hex.WriteString(fmt.Sprintf("%04X;\n", binary))
 	}
 
-	// Pad with 0s
-	for i := len(program); i < 64; i++ {
-		hex.WriteString("0000;\n")
+	output, ok := formatters[*format]
+	if !ok {
+		return fmt.Errorf("unknown output format: %s", *format)
+	}
+	if *endian != "big" && *endian != "little" {
+		return fmt.Errorf("unknown byte order: %s", *endian)
+	}
+	if *addrRadix != "oct" && *addrRadix != "dec" && *addrRadix != "hex" {
+		return fmt.Errorf("unknown address radix: %s", *addrRadix)
+	}
+	if *pad < 0 {
+		return fmt.Errorf("invalid -pad count: %d", *pad)
+	}
+	if *addrComments < 0 {
+		return fmt.Errorf("invalid -addr-comments interval: %d", *addrComments)
+	}
+	if *noPad && (flagGiven("pad") || flagGiven("size")) {
+		return errors.New("-no-pad can't be combined with -pad or -size")
 	}
 
-	return hex.String()
-}
+	ext := output.extension
+	if *extension != "" {
+		ext = "." + strings.TrimPrefix(*extension, ".")
+	}
 
-func parse(r io.Reader) ([]string, map[string]int) {
-	scanner := bufio.NewScanner(r)
+	hexFilename := *outputPath
+	if hexFilename == "" {
+		if filename != "" {
+			hexFilename = strings.TrimSuffix(filename, ".asm") + ext
+		} else if *stdinName != "" {
+			hexFilename = *stdinName + ext
+		}
+	}
 
-	tags := make(map[string]int)
-	var instructions []string
-	lineNum := 0
+	// Stdout only gets the output itself, so it can be piped into a file or
+	// another program
+	messages := os.Stderr
+	var trace io.Writer = messages
+	if *quiet {
+		trace = nil
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
+	// Catch a bad fill word before the source is assembled
+	if _, err := fillWord(cfg); err != nil {
+		return err
+	}
 
-		if line == "" || isComment(line) {
-			continue
+	asm := assembler.Assembler{Config: cfg, Trace: trace, MaxErrors: *maxErrors}
+	var program assembler.Program
+	if len(filenames) > 0 {
+		// The files are read one after the other as a single program, so
+		// tags can be used across files
+		program, err = asm.AssembleFiles(filenames...)
+		sourceFiles = program.Files
+	} else if len(inline) > 0 {
+		program, err = asm.Assemble(strings.NewReader(inlineSource(inline, cfg.Comment)))
+	} else {
+		program, err = asm.Assemble(os.Stdin)
+	}
+	if err != nil {
+		var errs assembler.AssemblyErrors
+		if !errors.As(err, &errs) {
+			return err
 		}
-
-		if isTag(line) {
-			tagName := line[1:]
-			tags[tagName] = lineNum
-		} else {
-			instructions = append(instructions, line)
-			lineNum++
+		errs = errs.Sorted()
+		printErrors(messages, errs)
+		if errors.Is(err, assembler.ErrTooManyErrors) {
+			fmt.Fprintf(messages, "%s\n\n", assembler.ErrTooManyErrors)
 		}
-	}
-
-	if err := scanner.Err(); err != nil {
-		if !errors.Is(err, io.EOF) {
-			panic(err)
+		if *format == "json" && !*check && !*verify {
+			// Tools reading the json output get the errors there as well,
+			// unless no output is written at all
+			if err := writeJSONErrors(hexFilename, errs); err != nil {
+				return err
+			}
+		}
+		if len(errs) == 1 {
+			return errors.New("assembly failed with 1 error")
 		}
+		return fmt.Errorf("assembly failed with %d errors", len(errs))
 	}
 
-	return instructions, tags
-}
-
-func assembleProgram(instructions []string, tags map[string]int) []string {
-	fmt.Printf("\nAssembling binary:\n\n")
-	fmt.Printf("%s\n", strings.Repeat("-", 39))
-
-	var assembled []string
-	for line, instr := range instructions {
-		program, err := assembleInstruction(instr, tags, line)
-		if err != nil {
-			fmt.Printf("Error assembling instruction: %s \n %s \n", err, instr)
-			hadError = true
-			continue
+	warnings := program.Warnings()
+	if *strict {
+		warnings = append(warnings, program.StrictWarnings()...)
+		if warning := paddingWarning(program, cfg); warning != "" {
+			warnings = append(warnings, warning)
 		}
-		assembled = append(assembled, program)
+	}
+	for _, warning := range warnings {
+		fmt.Fprintf(os.Stderr, "Warning: %s\n", warning)
+	}
+	if (*warnError || *strict) && len(warnings) > 0 {
+		return errors.New("warnings treated as errors")
+	}
+	if program.Size() > cfg.MemorySize {
+		return fmt.Errorf("program is %d words long but memory only holds %d", program.Size(), cfg.MemorySize)
+	}
+	if size := paddedSize(program, cfg); size > assembler.MaxMemorySize {
+		return fmt.Errorf("output would be %d words long, more than %d", size, assembler.MaxMemorySize)
 	}
 
-	fmt.Printf("%s\n\n", strings.Repeat("-", 39))
-
-	return assembled
-}
-
-func assembleInstruction(instruction string, tags map[string]int, line int) (string, error) {
-	parts := strings.Fields(instruction)
-
-	if len(parts) < 1 {
-		return "", fmt.Errorf("invalid instruction format: %s", instruction)
+	if *stats {
+		fmt.Fprintln(messages, formatStats(program, cfg))
 	}
 
-	opcode, ok := cfg.Opcodes[parts[0]]
-	if !ok {
-		return "", fmt.Errorf("unknown opcode: %s", parts[0])
+	if *check {
+		if !*quiet {
+			fmt.Fprintf(messages, "%d instructions assembled, no files written.\n", len(program.Words))
+		}
+		return nil
 	}
 
-	dest, data, err := getDestAndData(parts)
+	hex, err := output.format(program, cfg)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("formatting output: %w", err)
+	}
+	if !output.binary {
+		hex = lineEndings(hex)
 	}
 
-	if dest == "" {
-		dest = "0"
+	if *verify {
+		if err := verifyOutput(hex, expectedPath, output.binary); err != nil {
+			return err
+		}
+		if !*quiet {
+			fmt.Fprintf(messages, "%d instructions assembled, output matches %s.\n", len(program.Words), expectedPath)
+		}
+		return nil
 	}
 
-	if data == "" {
-		data = strings.Repeat("0", 8)
-	} else {
-		data, err = processData(data, tags)
+	if *listingPath != "" {
+		listing, err := formatListing(program, cfg)
 		if err != nil {
-			return "", err
+			return fmt.Errorf("formatting listing: %w", err)
+		}
+		if err := os.WriteFile(*listingPath, []byte(listing), 0644); err != nil {
+			return fmt.Errorf("writing listing: %w", err)
 		}
 	}
 
-	prettyInstruction := fmt.Sprintf("%s %s %s", opcode, dest, data)
-	paddedInstruction := fmt.Sprintf("%-20s", instruction)
-	fmt.Printf("%d: %s %-13s\n", line, paddedInstruction, prettyInstruction)
-
-	return opcode + dest + data, nil
-}
+	if *mapPath != "" {
+		if err := os.WriteFile(*mapPath, []byte(formatTagMap(program.Tags)), 0644); err != nil {
+			return fmt.Errorf("writing tag map: %w", err)
+		}
+	}
 
-func getDestAndData(parts []string) (dest string, data string, err error) {
-	switch len(parts) {
-	case 1: // Only opcode
-	case 2: // Opcode and either destination or data
-		if isDestination(parts[1]) {
-			dest, err = processDestination(parts[1])
-		} else {
-			data = parts[1]
+	if hexFilename != "" {
+		if err := os.WriteFile(hexFilename, []byte(hex), 0644); err != nil {
+			return fmt.Errorf("writing to file: %w", err)
 		}
-	case 3: // Opcode, destination and data
-		dest, err = processDestination(parts[1])
-		data = parts[2]
-	default:
-		err = fmt.Errorf("invalid instruction format: %s", strings.Join(parts, " "))
+		if !*quiet {
+			if *noPad {
+				fmt.Fprintf(messages, "%d instructions assembled and written to %s, %d words without padding.\n", len(program.Words), hexFilename, program.Size())
+			} else {
+				fmt.Fprintf(messages, "%d instructions assembled and written to %s.\n", len(program.Words), hexFilename)
+			}
+		}
+		return nil
 	}
-	return
-}
 
-func isDestination(part string) bool {
-	return part == "R0" || part == "R1"
+	if !*quiet {
+		fmt.Fprintf(messages, "%d instructions assembled.\n", len(program.Words))
+	}
+	if _, err := os.Stdout.WriteString(hex); err != nil {
+		return fmt.Errorf("writing output: %w", err)
+	}
+	return nil
 }
 
-func processDestination(dest string) (string, error) {
-	switch dest {
-	case "R0":
-		return "0", nil
-	case "R1":
-		return "1", nil
-	default:
-		return "", fmt.Errorf("invalid destination: %s", dest)
+// setUpConfig loads the config for the given source file and applies the
+// flags that change it.
+func setUpConfig(filename string) (assembler.Config, error) {
+	var (
+		cfg assembler.Config
+		err error
+	)
+	if path := resolveConfigPath(filename); path != "" {
+		cfg, err = loadConfig(path)
+	} else {
+		cfg, err = defaultConfig()
+	}
+	if err != nil {
+		return cfg, fmt.Errorf("loading config: %w", err)
 	}
+	if *memorySize != 0 {
+		cfg.MemorySize = *memorySize
+	}
+	cfg.Defines = append(cfg.Defines, defines...)
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
 }
 
-func processData(data string, tags map[string]int) (string, error) {
-	if strings.HasPrefix(data, "#") {
-		return processTag(data, tags)
+// writeJSONErrors writes the json output for a program with errors to the
+// output file, or to stdout when there is none.
+func writeJSONErrors(path string, errs assembler.AssemblyErrors) error {
+	output, err := formatJSONErrors(errs)
+	if err != nil {
+		return err
+	}
+	if path == "" {
+		_, err = os.Stdout.WriteString(output)
+	} else {
+		err = os.WriteFile(path, []byte(output), 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("writing output: %w", err)
 	}
-	return processBinOrDecData(data)
+	return nil
 }
 
-func processTag(data string, tags map[string]int) (string, error) {
-	name := data[1:]
-	address, ok := tags[name]
-	if !ok {
-		return "", fmt.Errorf("unknown tag: %s", name)
+// printErrors writes every error followed by the source line it is on, with a
+// caret under the token at fault when it is known, as a block of its own after
+// the trace.
+func printErrors(w io.Writer, errs assembler.AssemblyErrors) {
+	for _, err := range errs {
+		fmt.Fprintf(w, "Error: %s\n", err)
+		if source := strings.TrimSpace(err.Source); source != "" {
+			fmt.Fprintf(w, "    %s\n", source)
+			if err.Column > 0 {
+				// The column counts the indentation trimmed off above
+				indent := utf8.RuneCountInString(err.Source) - utf8.RuneCountInString(strings.TrimLeftFunc(err.Source, unicode.IsSpace))
+				fmt.Fprintf(w, "    %s\n", caret(source, err.Column-indent))
+			}
+		}
 	}
-	return fmt.Sprintf("%08b", address), nil
+	fmt.Fprintln(w)
 }
 
-func processBinOrDecData(data string) (string, error) {
-	if strings.HasPrefix(data, "0b") {
-		// Data is in binary format
-		data = data[2:]
-		if len(data) != 8 {
-			return "", fmt.Errorf("binary data should be 8 bits long: %s", data)
+// caret returns a line with a ^ under the given column of source, starting at
+// 1. Tabs before it are kept so it lines up however wide they are shown.
+func caret(source string, column int) string {
+	var line strings.Builder
+	for i, r := range []rune(source) {
+		if i == column-1 {
+			break
+		}
+		if r == '\t' {
+			line.WriteRune('\t')
+		} else {
+			line.WriteRune(' ')
 		}
-		return data, nil
 	}
+	line.WriteRune('^')
+	return line.String()
+}
 
-	// Data is in decimal format
-	decimal, err := strconv.Atoi(data)
-	if err != nil {
-		return "", fmt.Errorf("invalid decimal data: %s", data)
+// inlineSource joins the source given with -e into lines, starting a new line
+// at every semicolon outside a quoted literal. Semicolons are left alone when
+// they are part of the comment prefix, so they still start comments.
+func inlineSource(parts []string, comment string) string {
+	split := !strings.Contains(comment, ";")
+	var src strings.Builder
+	for _, part := range parts {
+		var quote rune
+		escaped := false
+		for _, r := range part {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case quote != 0:
+				if r == quote {
+					quote = 0
+				}
+			case r == '\'' || r == '"':
+				quote = r
+			case r == ';' && split:
+				r = '\n'
+			}
+			src.WriteRune(r)
+		}
+		src.WriteRune('\n')
 	}
-	return fmt.Sprintf("%08b", decimal), nil
+	return src.String()
+}
+
+// flagGiven reports whether the named flag was set on the command line.
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
 }
 
-func isComment(line string) bool {
-	return strings.HasPrefix(line, "//")
+// stringList collects the values of a flag that can be given more than once.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
 }
 
-func isTag(line string) bool {
-	return strings.HasPrefix(line, "#")
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
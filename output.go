@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// outputFormat turns an assembled program into the contents of an output
+// file.
+type outputFormat struct {
+	format    func(assembler.Program, assembler.Config) (string, error)
+	extension string // Default extension of the output file
+	binary    bool   // Whether the output is raw bytes rather than lines of text
+}
+
+// formatters holds every output format, keyed by the name used with -format.
+var formatters = map[string]outputFormat{
+	"logisim": {
+		format:    convertToHexAndFormat,
+		extension: ".hex",
+	},
+	"raw":       {format: formatRaw, extension: ".hex"},
+	"intelhex":  {format: formatIntelHex, extension: ".hex"},
+	"readmemh":  {format: formatReadmemh, extension: ".hex"},
+	"mif":       {format: formatMIF, extension: ".mif"},
+	"coe":       {format: formatCOE, extension: ".coe"},
+	"bin":       {format: formatBinary, extension: ".bin", binary: true},
+	"json":      {format: formatJSON, extension: ".json"},
+	"sourcemap": {format: formatSourceMap, extension: ".map"},
+	"goslice":   {format: formatGoSlice, extension: ".go"},
+	"pretty":    {format: formatPretty, extension: ".txt"},
+}
+
+func formatNames() []string {
+	names := make([]string, 0, len(formatters))
+	for name := range formatters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lineEndings ends the lines of text output with CRLF when -crlf is given, and
+// leaves out the newline after the last line with -no-final-newline.
+func lineEndings(text string) string {
+	if *trimNewline {
+		text = strings.TrimSuffix(text, "\n")
+	}
+	if *crlf {
+		text = strings.ReplaceAll(text, "\n", "\r\n")
+	}
+	return text
+}
+
+// convertToHexAndFormat renders memory as one hex word per line, each ending
+// in a semicolon. Logisim only reads words separated by whitespace, so the
+// semicolons are left out with -logisim.
+func convertToHexAndFormat(program assembler.Program, cfg assembler.Config) (string, error) {
+	if *logisimHeader {
+		return formatHexLines(program, cfg, "")
+	}
+	return formatHexLines(program, cfg, ";")
+}
+
+// formatRaw renders memory like the logisim format, but without the
+// semicolons.
+func formatRaw(program assembler.Program, cfg assembler.Config) (string, error) {
+	return formatHexLines(program, cfg, "")
+}
+
+// logisimImageHeader is the first line Logisim expects in a memory image file.
+const logisimImageHeader = "v2.0 raw"
+
+// formatHexLines writes one hex word per line, each followed by terminator.
+// With -logisim, the lines are preceded by the Logisim image header, and with
+// -rle runs of the same word are written once as count*word. With
+// -addr-comments, a # addr line marks the address of every Nth word.
+func formatHexLines(program assembler.Program, cfg assembler.Config, terminator string) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	// Logisim only skips comments starting with #
+	comments := annotations(program, "#")
+	var hex strings.Builder
+	if *logisimHeader {
+		hex.WriteString(logisimImageHeader + "\n")
+	}
+	marked := func(address int) bool {
+		return *addrComments > 0 && address%*addrComments == 0
+	}
+	for address := 0; address < len(words); address++ {
+		word := words[address]
+		if marked(address) {
+			hex.WriteString(fmt.Sprintf("# addr 0x%02X\n", address))
+		}
+		if *rle {
+			// Annotated words are kept on lines of their own so their
+			// comment stays next to them, and runs stop at address marks
+			run := 1
+			for address+run < len(words) && words[address+run] == word && comments[address] == "" && comments[address+run] == "" && !marked(address+run) {
+				run++
+			}
+			if run > 1 {
+				hex.WriteString(fmt.Sprintf("%d*%0*X%s\n", run, wordHexDigits(cfg), word, terminator))
+				address += run - 1
+				continue
+			}
+		}
+		hex.WriteString(fmt.Sprintf("%0*X%s%s\n", wordHexDigits(cfg), word, terminator, comments[address]))
+	}
+
+	return hex.String(), nil
+}
+
+// annotations returns a comment starting with marker for the address of every
+// assembled word, showing the address in decimal and hex along with the
+// source, when -annotate is given. Otherwise it returns no comments at all.
+func annotations(program assembler.Program, marker string) map[int]string {
+	comments := make(map[int]string)
+	if !*annotate {
+		return comments
+	}
+	for _, word := range program.Words {
+		address := word.Source.Address
+		comments[address] = fmt.Sprintf(" %s %d (0x%02X): %s", marker, address, address, word.Source.Text)
+	}
+	return comments
+}
+
+func wordToHex(word assembler.Word, cfg assembler.Config) (string, error) {
+	value, err := wordValue(word)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*X", wordHexDigits(cfg), value), nil
+}
+
+// wordValue converts an assembled word to an integer, naming the word and its
+// source line if it isn't a valid binary string. Words are valid by
+// construction, so this only guards against bugs in the assembler.
+func wordValue(word assembler.Word) (uint64, error) {
+	value, err := word.Value()
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid word %q for %s", word.Source.Location(), word.Bits(), word.Source.Text)
+	}
+	return value, nil
+}
+
+// paddedWords returns the value of every word in memory, filling gaps left by
+// .org and the end of memory with the -fill word. With -pad, memory ends that
+// many words after the program instead, unless -size is given as well, and
+// with -no-pad at the end of the program.
+func paddedWords(program assembler.Program, cfg assembler.Config) ([]uint64, error) {
+	fill, err := fillWord(cfg)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]uint64, paddedSize(program, cfg))
+	for i := range words {
+		words[i] = fill
+	}
+	for _, word := range program.Words {
+		value, err := wordValue(word)
+		if err != nil {
+			return nil, err
+		}
+		words[word.Source.Address] = value
+	}
+	return words, nil
+}
+
+// paddedSize is the number of words paddedWords writes.
+func paddedSize(program assembler.Program, cfg assembler.Config) int {
+	switch {
+	case *noPad:
+		return program.Size()
+	case flagGiven("pad") && *memorySize == 0:
+		return program.Size() + *pad
+	}
+	return max(program.Size(), cfg.MemorySize)
+}
+
+// paddingWarning describes the fill words written after a program, for
+// -strict. It is empty when nothing is padded.
+func paddingWarning(program assembler.Program, cfg assembler.Config) string {
+	size := program.Size()
+	padded := paddedSize(program, cfg)
+	if size == 0 || padded <= size {
+		return ""
+	}
+	fillWith := "zeros"
+	if *fill != "" {
+		fillWith = *fill
+	}
+	return fmt.Sprintf("program is %d words long and is padded with %s to %d", size, fillWith, padded)
+}
+
+// fillWord works out the word given with -fill, which is either a number
+// such as 0x0200 or an instruction such as RET that is assembled once. Unused
+// memory is filled with zeros when -fill isn't given.
+func fillWord(cfg assembler.Config) (uint64, error) {
+	if *fill == "" {
+		return 0, nil
+	}
+	if value, err := strconv.ParseUint(*fill, 0, 64); err == nil {
+		if value>>cfg.WordWidth != 0 {
+			return 0, fmt.Errorf("fill word %s doesn't fit in %d bits", *fill, cfg.WordWidth)
+		}
+		return value, nil
+	}
+
+	program, err := assembler.Assemble(strings.NewReader(*fill), cfg)
+	if err != nil {
+		return 0, fmt.Errorf("fill word: %w", err)
+	}
+	if len(program.Words) != 1 {
+		return 0, fmt.Errorf("fill word should be a single instruction: %s", *fill)
+	}
+	return wordValue(program.Words[0])
+}
+
+// wordBytes splits a word into bytes in the order chosen with -endian.
+func wordBytes(value uint64, cfg assembler.Config) []byte {
+	size := (cfg.WordWidth + 7) / 8
+	bytes := make([]byte, size)
+	for i := range bytes {
+		shift := 8 * i
+		if *endian == "big" {
+			shift = 8 * (size - 1 - i)
+		}
+		bytes[i] = byte(value >> shift)
+	}
+	return bytes
+}
+
+// The Intel HEX record types used by formatIntelHex.
+const (
+	intelHexData          = 0x00
+	intelHexEndOfFile     = 0x01
+	intelHexLinearAddress = 0x04
+)
+
+// intelHexRecordSize is the number of data bytes in each record.
+const intelHexRecordSize = 16
+
+// formatIntelHex renders memory as Intel HEX records, ending with an end of
+// file record. Extended linear address records are written when memory is
+// larger than 64 KiB.
+func formatIntelHex(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	for _, word := range words {
+		data = append(data, wordBytes(word, cfg)...)
+	}
+
+	var hex strings.Builder
+	for address := 0; address < len(data); address += intelHexRecordSize {
+		if address > 0 && address%0x10000 == 0 {
+			upper := address >> 16
+			writeIntelHexRecord(&hex, 0, intelHexLinearAddress, []byte{byte(upper >> 8), byte(upper)})
+		}
+		end := min(address+intelHexRecordSize, len(data))
+		writeIntelHexRecord(&hex, address&0xFFFF, intelHexData, data[address:end])
+	}
+	writeIntelHexRecord(&hex, 0, intelHexEndOfFile, nil)
+
+	return hex.String(), nil
+}
+
+func writeIntelHexRecord(hex *strings.Builder, address int, recordType byte, data []byte) {
+	record := append([]byte{byte(len(data)), byte(address >> 8), byte(address), recordType}, data...)
+
+	var sum byte
+	for _, b := range record {
+		sum += b
+	}
+
+	hex.WriteString(":")
+	for _, b := range record {
+		hex.WriteString(fmt.Sprintf("%02X", b))
+	}
+	hex.WriteString(fmt.Sprintf("%02X\n", -sum))
+}
+
+// formatReadmemh renders memory as one hex word per line for Verilog's
+// $readmemh. With -sparse, addresses no word was assembled at are skipped and
+// each run of assembled words starts with an @address marker instead.
+func formatReadmemh(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	assembled := make(map[int]bool, len(program.Words))
+	for _, word := range program.Words {
+		assembled[word.Source.Address] = true
+	}
+
+	comments := annotations(program, "//")
+	var hex strings.Builder
+	skipped := false
+	for address, word := range words {
+		if *sparse {
+			if !assembled[address] {
+				skipped = true
+				continue
+			}
+			if skipped || address == 0 {
+				hex.WriteString(fmt.Sprintf("@%X\n", address))
+				skipped = false
+			}
+		}
+		hex.WriteString(fmt.Sprintf("%0*X%s\n", wordHexDigits(cfg), word, comments[address]))
+	}
+
+	return hex.String(), nil
+}
+
+// wordHexDigits is the number of hex digits needed to write a whole word.
+func wordHexDigits(cfg assembler.Config) int {
+	return (cfg.WordWidth + 3) / 4
+}
+
+// formatMIF renders memory as an Altera/Intel memory initialization file.
+// Runs of identical words are collapsed into a single address range.
+func formatMIF(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var mif strings.Builder
+	mif.WriteString(fmt.Sprintf("WIDTH=%d;\n", cfg.WordWidth))
+	mif.WriteString(fmt.Sprintf("DEPTH=%d;\n\n", len(words)))
+	mif.WriteString("ADDRESS_RADIX=HEX;\n")
+	mif.WriteString("DATA_RADIX=HEX;\n\n")
+	mif.WriteString("CONTENT BEGIN\n")
+
+	for start := 0; start < len(words); {
+		end := start
+		for end+1 < len(words) && words[end+1] == words[start] {
+			end++
+		}
+		if end > start {
+			mif.WriteString(fmt.Sprintf("\t[%X..%X] : %0*X;\n", start, end, wordHexDigits(cfg), words[start]))
+		} else {
+			mif.WriteString(fmt.Sprintf("\t%X : %0*X;\n", start, wordHexDigits(cfg), words[start]))
+		}
+		start = end + 1
+	}
+
+	mif.WriteString("END;\n")
+	return mif.String(), nil
+}
+
+// formatCOE renders memory as a Xilinx coefficient file for block memory.
+func formatCOE(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var coe strings.Builder
+	coe.WriteString("memory_initialization_radix=16;\n")
+	coe.WriteString("memory_initialization_vector=\n")
+	for i, word := range words {
+		separator := ","
+		if i == len(words)-1 {
+			separator = ";"
+		}
+		coe.WriteString(fmt.Sprintf("%0*X%s\n", wordHexDigits(cfg), word, separator))
+	}
+
+	return coe.String(), nil
+}
+
+// prettyRowWords is the number of words on each row of the pretty format.
+const prettyRowWords = 8
+
+// formatPretty renders memory for people to read, as rows of words each
+// starting with the address of the first word on it.
+func formatPretty(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	addressDigits := len(formatAddress(max(len(words)-1, 0), 2))
+	var pretty strings.Builder
+	for start := 0; start < len(words); start += prettyRowWords {
+		pretty.WriteString(fmt.Sprintf("%s:", formatAddress(start, addressDigits)))
+		for _, word := range words[start:min(start+prettyRowWords, len(words))] {
+			pretty.WriteString(fmt.Sprintf(" %0*X", wordHexDigits(cfg), word))
+		}
+		pretty.WriteString("\n")
+	}
+
+	return pretty.String(), nil
+}
+
+// formatBinary renders memory as raw bytes, with each word split into bytes in
+// the order chosen with -endian.
+func formatBinary(program assembler.Program, cfg assembler.Config) (string, error) {
+	words, err := paddedWords(program, cfg)
+	if err != nil {
+		return "", err
+	}
+
+	var data []byte
+	for _, word := range words {
+		data = append(data, wordBytes(word, cfg)...)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// setFlag sets a flag global for the rest of the test.
+func setFlag[T any](t *testing.T, flag *T, value T) {
+	t.Helper()
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// assembleSample assembles the sample program with the embedded config.
+func assembleSample(t *testing.T) (assembler.Program, assembler.Config) {
+	t.Helper()
+	cfg, err := setUpConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := (&assembler.Assembler{Config: cfg}).AssembleFiles("programs/test.asm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program, cfg
+}
+
+// assembleWith assembles src with a config that has the opcode LOD and the
+// given data width, defaulting everything else.
+func assembleWith(t *testing.T, src, opcode string, dataWidth int) (assembler.Program, assembler.Config) {
+	t.Helper()
+	cfg := assembler.Config{Opcodes: map[string]string{"LOD": opcode}, DataWidth: dataWidth, MemorySize: 2}
+	cfg.SetDefaults()
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	program, err := assembler.Assemble(strings.NewReader(src), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program, cfg
+}
+
+func TestHexLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*testing.T)
+		want   string
+	}{
+		{"logisim", func(*testing.T) {}, "0C0A;\n0A01;\n0404;\n0601;\n0604;\n" + strings.Repeat("0000;\n", 59)},
+		{"rle", func(t *testing.T) {
+			setFlag(t, rle, true)
+		}, "0C0A;\n0A01;\n0404;\n0601;\n0604;\n59*0000;\n"},
+		{"logisim header", func(t *testing.T) {
+			setFlag(t, logisimHeader, true)
+			setFlag(t, rle, true)
+		}, "v2.0 raw\n0C0A\n0A01\n0404\n0601\n0604\n59*0000\n"},
+		{"addr comments", func(t *testing.T) {
+			setFlag(t, rle, true)
+			setFlag(t, addrComments, 32)
+		}, "# addr 0x00\n0C0A;\n0A01;\n0404;\n0601;\n0604;\n27*0000;\n# addr 0x20\n32*0000;\n"},
+		{"annotate", func(t *testing.T) {
+			setFlag(t, annotate, true)
+			setFlag(t, noPad, true)
+		}, "0C0A; # 0 (0x00): LOD R0 10\n0A01; # 1 (0x01): SUB R0 1\n0404; # 2 (0x02): BRZ R0 #end\n" +
+			"0601; # 3 (0x03): BRN #loop\n0604; # 4 (0x04): BRN #end\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+			program, cfg := assembleSample(t)
+			got, err := convertToHexAndFormat(program, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHexWordWidths(t *testing.T) {
+	tests := []struct {
+		name      string
+		opcode    string
+		dataWidth int
+		want      string
+	}{
+		{"8 bit", "011", 4, "7F;\n00;\n"},
+		{"12 bit", "0110", 7, "6FF;\n000;\n"},
+		{"16 bit", "0110000", 8, "61FF;\n0000;\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program, cfg := assembleWith(t, "LOD R1 -1", tt.opcode, tt.dataWidth)
+			got, err := formatHexLines(program, cfg, ";")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMalformedWord(t *testing.T) {
+	_, cfg := assembleSample(t)
+	word := assembler.Word{
+		Opcode: "01x0",
+		Dest:   "0",
+		Data:   "00000001",
+		Source: assembler.Instruction{Text: "LOD R0 1", Line: 3, File: "x.asm"},
+	}
+	_, err := wordToHex(word, cfg)
+	want := `line 3 of x.asm: invalid word "01x0000000001" for LOD R0 1`
+	if err == nil || err.Error() != want {
+		t.Errorf("wordToHex() = %v, want %q", err, want)
+	}
+
+	program := assembler.Program{Words: []assembler.Word{word}}
+	if _, err := formatIntelHex(program, cfg); err == nil || err.Error() != want {
+		t.Errorf("formatIntelHex() = %v, want %q", err, want)
+	}
+}
+
+func TestIntelHex(t *testing.T) {
+	want, err := os.ReadFile("testdata/test_intelhex.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, cfg := assembleSample(t)
+	got, err := formatIntelHex(program, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	for _, record := range strings.Fields(got) {
+		var sum byte
+		for i := 1; i+1 < len(record); i += 2 {
+			var b byte
+			for _, c := range record[i : i+2] {
+				b = b<<4 | byte(strings.IndexRune("0123456789ABCDEF", c))
+			}
+			sum += b
+		}
+		if sum != 0 {
+			t.Errorf("record %s doesn't sum to zero", record)
+		}
+	}
+}
+
+func TestIntelHexLinearAddress(t *testing.T) {
+	program, cfg := assembleSample(t)
+	cfg.MemorySize = 40000
+	got, err := formatIntelHex(program, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := strings.Fields(got)
+	// 40000 two byte words take 5000 data records, with the upper address
+	// changing once after the first 4096
+	if len(records) != 5002 {
+		t.Fatalf("got %d records, want 5002", len(records))
+	}
+	if records[4096] != ":020000040001F9" {
+		t.Errorf("record 4096 is %s, want the extended linear address 0x0001", records[4096])
+	}
+	if records[4097] != ":1000000000000000000000000000000000000000F0" {
+		t.Errorf("record 4097 is %s, want data at address 0 of the second 64 KiB", records[4097])
+	}
+}
+
+func TestReadmemhSparse(t *testing.T) {
+	setFlag(t, sparse, true)
+	cfg, err := setUpConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := assembler.Assemble(strings.NewReader("LOD R0 1\nCAL\nRET\n.org 6\nRET\n.word 0"), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := formatReadmemh(program, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Zero words that were assembled are kept, and only the gap left by
+	// .org and the padding are skipped
+	want := "@0\n0C01\n0000\n0200\n@6\n0200\n0000\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boenkyo/lasm/assembler"
+)
+
+// formatStats renders how many times each opcode is used, most used first,
+// followed by the program size and the memory left over. Words from data
+// directives are counted as data.
+func formatStats(program assembler.Program, cfg assembler.Config) string {
+	counts := make(map[string]int)
+	for _, word := range program.Words {
+		name := "(data)"
+		if word.Opcode != "" {
+			names, _ := cfg.OpcodeNames()
+			name = names[word.Opcode]
+		}
+		counts[name]++
+	}
+
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	var stats strings.Builder
+	stats.WriteString("OPCODE  COUNT\n")
+	for _, name := range names {
+		stats.WriteString(fmt.Sprintf("%-6s  %5d\n", name, counts[name]))
+	}
+	stats.WriteString(fmt.Sprintf("\n%d instructions, %d of %d words free\n", len(program.Words), cfg.MemorySize-program.Size(), cfg.MemorySize))
+	return stats.String()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// verifyOutput compares the output line by line against the expected output
+// in a file, ignoring trailing whitespace and trailing blank lines, and
+// reports the first line that differs. Binary output is compared byte for
+// byte instead.
+func verifyOutput(output, path string, binary bool) error {
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading expected output: %w", err)
+	}
+	if binary {
+		return verifyBytes([]byte(output), expected, path)
+	}
+
+	got, want := outputLines(output), outputLines(string(expected))
+	for i := 0; i < len(got) || i < len(want); i++ {
+		switch {
+		case i >= len(got):
+			return fmt.Errorf("output ends before line %d of %s: %s", i+1, path, want[i])
+		case i >= len(want):
+			return fmt.Errorf("output continues past the end of %s on line %d: %s", path, i+1, got[i])
+		case got[i] != want[i]:
+			return fmt.Errorf("output differs from %s on line %d:\n  got:      %s\n  expected: %s", path, i+1, got[i], want[i])
+		}
+	}
+	return nil
+}
+
+// verifyBytes reports the first byte of binary output that differs from the
+// expected output.
+func verifyBytes(got, want []byte, path string) error {
+	if bytes.Equal(got, want) {
+		return nil
+	}
+	for i := 0; i < len(got) && i < len(want); i++ {
+		if got[i] != want[i] {
+			return fmt.Errorf("output differs from %s at byte %d: got 0x%02X, expected 0x%02X", path, i, got[i], want[i])
+		}
+	}
+	if len(got) < len(want) {
+		return fmt.Errorf("output is %d bytes long, but %s is %d bytes", len(got), path, len(want))
+	}
+	return fmt.Errorf("output continues past the end of %s, which is %d bytes, to %d bytes", path, len(want), len(got))
+}
+
+// outputLines splits output into lines without trailing whitespace, leaving
+// out the blank lines at the end.
+func outputLines(output string) []string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
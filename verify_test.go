@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected string
+		binary   bool
+		wantErr  string
+	}{
+		{"same text", "0C0A;\n0A01;\n", "0C0A;\n0A01;\n", false, ""},
+		{"trailing whitespace", "0C0A;\n0A01;\n", "0C0A; \r\n0A01;\n\n", false, ""},
+		{"different line", "0C0A;\n0A01;\n", "0C0A;\n0A00;\n", false, "output differs from expected on line 2"},
+		{"missing line", "0C0A;\n", "0C0A;\n0A01;\n", false, "output ends before line 2 of expected: 0A01;"},
+		{"same bytes", "\x0C\x20\x0A\x00", "\x0C\x20\x0A\x00", true, ""},
+		{"different byte", "\x0C\x20\x0A\x00", "\x0C\x09\x0A\x00", true, "output differs from expected at byte 1: got 0x20, expected 0x09"},
+		{"missing byte", "\x0C\x20", "\x0C\x20\x20", true, "output is 2 bytes long, but expected is 3 bytes"},
+		{"extra bytes", "\x0C\x20\x0D", "\x0C\x20", true, "output continues past the end of expected, which is 2 bytes, to 3 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "expected")
+			if err := os.WriteFile(path, []byte(tt.expected), 0644); err != nil {
+				t.Fatal(err)
+			}
+			err := verifyOutput(tt.output, path, tt.binary)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("verifyOutput() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(strings.ReplaceAll(err.Error(), path, "expected"), tt.wantErr) {
+				t.Errorf("verifyOutput() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
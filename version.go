@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build information, set at build time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// printVersion prints the version along with the commit and date the binary
+// was built from. Without ldflags, the commit and date recorded by the go
+// tool are used when available.
+func printVersion() {
+	c, d := commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if c == "" {
+					c = setting.Value
+				}
+			case "vcs.time":
+				if d == "" {
+					d = setting.Value
+				}
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	fmt.Printf("lasm %s (commit %s, built %s)\n", version, c, d)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"time"
+)
+
+// watchInterval is how often watched files are checked for changes.
+const watchInterval = 500 * time.Millisecond
+
+// sourceFiles holds the files read by the last build, including those pulled
+// in with .include, so watch mode notices changes to any of them.
+var sourceFiles []string
+
+// watch assembles the files, then assembles them again every time one of
+// them, a file they include or the config file changes. It runs until the
+// program is interrupted, and a failed pass is only reported so the next
+// change is still picked up.
+func watch(filenames []string) {
+	var last map[string]time.Time
+	for {
+		current := modTimes(watchedPaths(filenames))
+		if !maps.Equal(current, last) {
+			stamp := time.Now().Format("15:04:05")
+			if err := build(filenames); err != nil {
+				fmt.Fprintf(os.Stderr, "[%s] Error: %s\n", stamp, err)
+			} else {
+				fmt.Fprintf(os.Stderr, "[%s] Assembled successfully\n", stamp)
+			}
+			// The build can change which files are included. Files seen
+			// before keep the time from before the build, so changes made
+			// during it still cause another one
+			last = modTimes(watchedPaths(filenames))
+			for path := range last {
+				if modified, ok := current[path]; ok {
+					last[path] = modified
+				}
+			}
+			fmt.Fprintln(os.Stderr, "Watching for changes, press Ctrl+C to stop.")
+		}
+		time.Sleep(watchInterval)
+	}
+}
+
+// watchedPaths lists the input files and the files they included in the last
+// build, along with the config file they use.
+func watchedPaths(filenames []string) []string {
+	paths := append([]string(nil), filenames...)
+	paths = append(paths, sourceFiles...)
+	if path := resolveConfigPath(filenames[0]); path != "" {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// modTimes returns the modification time of each path. Missing files get the
+// zero time, so creating them again counts as a change.
+func modTimes(paths []string) map[string]time.Time {
+	times := make(map[string]time.Time, len(paths))
+	for _, path := range paths {
+		var modified time.Time
+		if info, err := os.Stat(path); err == nil {
+			modified = info.ModTime()
+		}
+		times[path] = modified
+	}
+	return times
+}